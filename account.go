@@ -0,0 +1,110 @@
+package acmev2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// Account is the account object returned by the ACME server.
+type Account struct {
+	Status               string   `json:"status"`
+	Contact              []string `json:"contact"`
+	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+	Orders               string   `json:"orders"`
+	// URL is the account URL, which is also used as the KID for signed requests.
+	URL string `json:"-"`
+	// TermsOfService is the URL of the terms of service agreed to when the account was created
+	// by this client.   The server doesn't report it back, so it's empty for looked up accounts.
+	TermsOfService string `json:"-"`
+}
+
+// AccountUpdate is the payload for changing the contacts or status of an existing account.
+type AccountUpdate struct {
+	Contact []string `json:"contact,omitempty"`
+	Status  string   `json:"status,omitempty"`
+}
+
+// LookupAccount asks the server for the account belonging to Client.Key without creating
+// one if it doesn't exist.   On success, Client.KID is set to the account URL.
+func (c *Client) LookupAccount(ctx context.Context) (Account, error) {
+	return c.postAccount(ctx, NewAccount{OnlyReturnExisting: true}, c.Directory.NewAccount)
+}
+
+// FetchAccount fetches the current account object, including its status and orders URL.
+func (c *Client) FetchAccount(ctx context.Context) (Account, error) {
+	if c.KID == "" {
+		return Account{}, errors.New("no account KID set, look up or create the account first")
+	}
+	return c.postAccount(ctx, nil, c.KID)
+}
+
+// UpdateAccountContacts replaces the contact emails on the account.   Emails without a
+// "mailto:" prefix will have one added.   Client.ContactEmails is updated on success.
+func (c *Client) UpdateAccountContacts(ctx context.Context, contactEmails []string) (Account, error) {
+	if c.KID == "" {
+		return Account{}, errors.New("no account KID set, look up or create the account first")
+	}
+	contacts := prependContacts(contactEmails)
+	acct, err := c.postAccount(ctx, AccountUpdate{Contact: contacts}, c.KID)
+	if err != nil {
+		return acct, err
+	}
+	c.ContactEmails = contacts
+	return acct, c.saveAccount()
+}
+
+// DeactivateAccount deactivates the account.   This can't be undone, the server will
+// refuse any further requests signed with the account key.   The account is marked as
+// deactivated in the client's AccountStore, if any, so that later runs start a new one.
+func (c *Client) DeactivateAccount(ctx context.Context) (Account, error) {
+	if c.KID == "" {
+		return Account{}, errors.New("no account KID set, look up or create the account first")
+	}
+	acct, err := c.postAccount(ctx, AccountUpdate{Status: StatusDeactivated}, c.KID)
+	if err != nil {
+		return acct, err
+	}
+	return acct, c.storeAccount(true)
+}
+
+// OrderList is a page of the account's orders list.
+type OrderList struct {
+	Orders []string `json:"orders"`
+}
+
+// ListOrders fetches the URLs of the account's orders, following the list across pages.   RFC 8555
+// leaves it up to the CA which orders are listed, most only list pending and valid ones, and some
+// (Let's Encrypt among them) don't provide the list at all.
+func (c *Client) ListOrders(ctx context.Context) ([]string, error) {
+	acct, err := c.FetchAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if acct.Orders == "" {
+		return nil, errors.New("CA does not provide an orders list for the account")
+	}
+
+	var orders []string
+	seen := make(map[string]bool)
+	for url := acct.Orders; url != "" && !seen[url]; {
+		seen[url] = true
+		res, err := c.post(ctx, nil, url, true)
+		if err != nil {
+			return orders, err
+		}
+		var page OrderList
+		if err := json.Unmarshal(res.Body, &page); err != nil {
+			return orders, err
+		}
+		orders = append(orders, page.Orders...)
+
+		next := linkURLs(res.Header, url, "next")
+		url = ""
+		if len(next) > 0 {
+			url = next[0]
+		}
+	}
+
+	return orders, nil
+}
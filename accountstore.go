@@ -0,0 +1,188 @@
+package acmev2
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// StoredAccount is what gets persisted for an ACME account so that it can be re-used by later runs.
+// Keys that can't be exported, such as ones living in an HSM or KMS, aren't stored, in which case Key
+// is nil when loading the account and KeyThumbprint tells which key the account belongs to.
+// Deactivated accounts stay in the store marked as such, so that they aren't used again.
+type StoredAccount struct {
+	Key            crypto.Signer
+	KeyThumbprint  string
+	KID            string
+	Contacts       []string
+	TermsOfService string
+	Deactivated    bool
+}
+
+// matchesKey tells whether the stored account belongs to key.
+func (a *StoredAccount) matchesKey(key crypto.Signer) bool {
+	if a.Key != nil {
+		return publicKeysEqual(a.Key.Public(), key.Public())
+	}
+	return a.KeyThumbprint != "" && a.KeyThumbprint == keyThumbprint(key)
+}
+
+// keyThumbprint returns the base64url encoded JWK thumbprint of key, or "" if there's none.
+func keyThumbprint(key crypto.Signer) string {
+	thumb, err := JWKThumbprint(key, crypto.SHA256)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(thumb)
+}
+
+// AccountStore is an interface that provides a way to persist an ACME account, keyed by the directory
+// URL of the CA it belongs to.   LoadAccount should return nil, nil if no account has been stored for
+// the directory vs. an actual error trying to load it.
+type AccountStore interface {
+	LoadAccount(dirURL string) (*StoredAccount, error)
+	SaveAccount(dirURL string, acct StoredAccount) error
+}
+
+// storedAccountJSON is the serialized form of a StoredAccount, with the key PEM encoded.
+type storedAccountJSON struct {
+	Key            string   `json:"key,omitempty"`
+	KeyThumbprint  string   `json:"keyThumbprint,omitempty"`
+	KID            string   `json:"kid"`
+	Contacts       []string `json:"contacts"`
+	TermsOfService string   `json:"termsOfService,omitempty"`
+	Deactivated    bool     `json:"deactivated,omitempty"`
+}
+
+func marshalStoredAccount(acct StoredAccount) ([]byte, error) {
+	if acct.Key == nil {
+		return nil, errors.New("no account key to store")
+	}
+	var keyPEM []byte
+	if der, err := x509.MarshalPKCS8PrivateKey(acct.Key); err == nil {
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+
+	return json.Marshal(storedAccountJSON{
+		Key:            string(keyPEM),
+		KeyThumbprint:  keyThumbprint(acct.Key),
+		KID:            acct.KID,
+		Contacts:       acct.Contacts,
+		TermsOfService: acct.TermsOfService,
+		Deactivated:    acct.Deactivated,
+	})
+}
+
+func unmarshalStoredAccount(b []byte) (*StoredAccount, error) {
+	var s storedAccountJSON
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	acct := &StoredAccount{
+		KeyThumbprint:  s.KeyThumbprint,
+		KID:            s.KID,
+		Contacts:       s.Contacts,
+		TermsOfService: s.TermsOfService,
+		Deactivated:    s.Deactivated,
+	}
+	if s.Key == "" {
+		if s.KeyThumbprint == "" {
+			return nil, errors.New("stored account has neither a key nor a key thumbprint")
+		}
+		return acct, nil
+	}
+
+	block, _ := pem.Decode([]byte(s.Key))
+	if block == nil {
+		return nil, errors.New("no PEM encoded account key found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported account key type %T", parsed)
+	}
+	acct.Key = key
+
+	return acct, nil
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// accountName turns a directory URL into something usable as a file or secret name.
+func accountName(dirURL string) string {
+	name := dirURL
+	if u, err := url.Parse(dirURL); err == nil && u.Host != "" {
+		name = u.Host + u.Path
+	}
+	return unsafeNameChars.ReplaceAllString(name, "_")
+}
+
+// FileAccountStore implements AccountStore by keeping one JSON file per directory URL in Dir.
+type FileAccountStore struct {
+	Dir string
+}
+
+// NewFileAccountStore returns a pointer to a FileAccountStore keeping its files in dir.
+func NewFileAccountStore(dir string) *FileAccountStore {
+	return &FileAccountStore{Dir: dir}
+}
+
+// LoadAccount reads the account stored for dirURL, if there is one.
+func (s *FileAccountStore) LoadAccount(dirURL string) (*StoredAccount, error) {
+	b, err := ioutil.ReadFile(s.path(dirURL))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalStoredAccount(b)
+}
+
+// SaveAccount writes the account for dirURL, readable only by the current user.
+func (s *FileAccountStore) SaveAccount(dirURL string, acct StoredAccount) error {
+	b, err := marshalStoredAccount(acct)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path(dirURL), b, 0600)
+}
+
+func (s *FileAccountStore) path(dirURL string) string {
+	return filepath.Join(s.Dir, accountName(dirURL)+".json")
+}
+
+// saveAccount persists the current account if the client has an AccountStore.
+func (c *Client) saveAccount() error {
+	return c.storeAccount(false)
+}
+
+// storeAccount persists the current account, marked as deactivated or not, if the client has an
+// AccountStore.
+func (c *Client) storeAccount(deactivated bool) error {
+	if c.AccountStore == nil {
+		return nil
+	}
+	return c.AccountStore.SaveAccount(c.DirectoryURL, StoredAccount{
+		Key:            c.Key,
+		KID:            c.KID,
+		Contacts:       c.ContactEmails,
+		TermsOfService: c.TermsOfService,
+		Deactivated:    deactivated,
+	})
+}
@@ -1,7 +1,36 @@
 package acmev2
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestSplitHostname(t *testing.T) {
@@ -40,3 +69,1970 @@ func TestSplitHostname(t *testing.T) {
 		}
 	}
 }
+
+func TestParseDirectoryMeta(t *testing.T) {
+	dirJSON := []byte(`{
+		"newAccount": "https://example.org/acme/new-acct",
+		"newAuthz": "https://example.org/acme/new-authz",
+		"meta": {
+			"termsOfService": "https://example.org/tos.pdf",
+			"website": "https://example.org",
+			"caaIdentities": ["example.org"],
+			"externalAccountRequired": true,
+			"profiles": {"classic": "The same profile as always", "shortlived": "Six day certs"}
+		}
+	}`)
+
+	d, err := Parse(dirJSON)
+	if err != nil {
+		t.Fatalf("failed parsing directory: %v", err)
+	}
+
+	if d.NewAuthz != "https://example.org/acme/new-authz" {
+		t.Errorf("expected newAuthz %q, got %q", "https://example.org/acme/new-authz", d.NewAuthz)
+	}
+	if d.Meta.TermsOfService != "https://example.org/tos.pdf" {
+		t.Errorf("expected terms of service %q, got %q", "https://example.org/tos.pdf", d.Meta.TermsOfService)
+	}
+	if !d.Meta.ExternalAccountRequired {
+		t.Errorf("expected externalAccountRequired to be true")
+	}
+	if len(d.Meta.CAAIdentities) != 1 || d.Meta.CAAIdentities[0] != "example.org" {
+		t.Errorf("unexpected CAA identities %v", d.Meta.CAAIdentities)
+	}
+	if _, ok := d.Meta.Profiles["shortlived"]; !ok || len(d.Meta.Profiles) != 2 {
+		t.Errorf("unexpected profiles %v", d.Meta.Profiles)
+	}
+}
+
+func TestFileAccountStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmev2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileAccountStore(dir)
+	dirURL := "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+	acct, err := store.LoadAccount(dirURL)
+	if err != nil || acct != nil {
+		t.Fatalf("expected no account and no error before saving, got %v, %v", acct, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SaveAccount(dirURL, StoredAccount{
+		Key:      key,
+		KID:      "https://example.org/acme/acct/1",
+		Contacts: []string{"mailto:somebody@example.org"},
+	})
+	if err != nil {
+		t.Fatalf("failed saving account: %v", err)
+	}
+
+	acct, err = store.LoadAccount(dirURL)
+	if err != nil {
+		t.Fatalf("failed loading account: %v", err)
+	}
+	if acct.KID != "https://example.org/acme/acct/1" {
+		t.Errorf("expected KID %q, got %q", "https://example.org/acme/acct/1", acct.KID)
+	}
+	if len(acct.Contacts) != 1 || acct.Contacts[0] != "mailto:somebody@example.org" {
+		t.Errorf("unexpected contacts %v", acct.Contacts)
+	}
+	if loaded, ok := acct.Key.(*ecdsa.PrivateKey); !ok || loaded.D.Cmp(key.D) != 0 {
+		t.Errorf("loaded key doesn't match saved key")
+	}
+}
+
+func TestFileAccountStoreOpaqueKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmev2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"newNonce": "https://example.org/acme/new-nonce", "newAccount": "https://example.org/acme/new-account"}`))
+	}))
+	defer srv.Close()
+
+	store := NewFileAccountStore(dir)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key := opaqueSigner{p256}
+	err = store.SaveAccount(srv.URL, StoredAccount{
+		Key:      key,
+		KID:      "https://example.org/acme/acct/1",
+		Contacts: []string{"mailto:somebody@example.org"},
+	})
+	if err != nil {
+		t.Fatalf("failed saving account with a key that can't be exported: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(store.path(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "PRIVATE KEY") {
+		t.Errorf("expected no key to be stored, got %s", b)
+	}
+
+	acct, err := store.LoadAccount(srv.URL)
+	if err != nil {
+		t.Fatalf("failed loading account: %v", err)
+	}
+	if acct.Key != nil || acct.KID != "https://example.org/acme/acct/1" {
+		t.Errorf("expected only the KID to come back, got key %v and KID %q", acct.Key, acct.KID)
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !acct.matchesKey(key) || acct.matchesKey(other) {
+		t.Errorf("stored account should match its own key and only that")
+	}
+
+	c, err := NewClient(srv.URL, nil, nil, ClientOpts{AccountKey: key, AccountStore: store})
+	if err != nil {
+		t.Fatalf("failed creating client: %v", err)
+	}
+	if c.KID != "https://example.org/acme/acct/1" || len(c.ContactEmails) != 1 {
+		t.Errorf("expected the stored account to be loaded for the same key, got KID %q and contacts %v", c.KID, c.ContactEmails)
+	}
+
+	c, err = NewClient(srv.URL, nil, nil, ClientOpts{AccountKey: other, AccountStore: store})
+	if err != nil {
+		t.Fatalf("failed creating client: %v", err)
+	}
+	if c.KID != "" {
+		t.Errorf("expected the stored account to be ignored for another key, got KID %q", c.KID)
+	}
+
+	if _, err := NewClient(srv.URL, nil, nil, ClientOpts{AccountStore: store}); err == nil {
+		t.Errorf("expected an error instead of a new key when the stored account's key isn't exportable")
+	}
+}
+
+// opaqueSigner hides the concrete key type the way an HSM or KMS backed signer would.
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestMarshalKeyPEM(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		Name      string
+		Key       crypto.Signer
+		BlockType string
+	}{
+		{"P-256", p256, "PRIVATE KEY"},
+		{"RSA", rsaKey, "RSA PRIVATE KEY"},
+		{"Opaque P-256", opaqueSigner{p256}, ""},
+	}
+
+	for _, test := range tests {
+		keyPEM, err := marshalKeyPEM(test.Key)
+		if err != nil {
+			t.Errorf("test %q: failed marshaling key: %v", test.Name, err)
+			continue
+		}
+		if test.BlockType == "" {
+			if keyPEM != "" {
+				t.Errorf("test %q: expected a key that can't be exported to come back empty, got %q", test.Name, keyPEM)
+			}
+			continue
+		}
+		block, _ := pem.Decode([]byte(keyPEM))
+		if block == nil || block.Type != test.BlockType {
+			t.Errorf("test %q: expected a %s PEM block, got %q", test.Name, test.BlockType, keyPEM)
+		}
+	}
+}
+
+// verifyJWS tells whether the signature of msg checks out for pub.
+func verifyJWS(msg Message, pub crypto.PublicKey) bool {
+	sig, _ := base64.RawURLEncoding.DecodeString(msg.Signature)
+	signed := []byte(msg.Protected + "." + msg.Payload)
+
+	_, sha := jwsHasher(pub)
+	var digest []byte
+	if sha != 0 {
+		h := sha.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		size := len(sig) / 2
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, sha, digest, sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, signed, sig)
+	}
+	return false
+}
+
+func TestJWSSignatureKeyTypes(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		Name string
+		Key  crypto.Signer
+	}{
+		{"P-256", p256},
+		{"P-521", p521},
+		{"Opaque P-256", opaqueSigner{p256}},
+		{"RSA", rsaKey},
+		{"Ed25519", edKey},
+	}
+
+	for _, test := range tests {
+		if err := validateAccountKey(test.Key); err != nil {
+			t.Errorf("test %q: key should be valid: %v", test.Name, err)
+			continue
+		}
+
+		token, err := jwsEncodeJSONWithJWK(test.Key, map[string]string{"hello": "world"}, "https://example.org/acme")
+		if err != nil {
+			t.Errorf("test %q: failed encoding JWS: %v", test.Name, err)
+			continue
+		}
+
+		var msg Message
+		if err := json.Unmarshal(token, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if !verifyJWS(msg, test.Key.Public()) {
+			t.Errorf("test %q: signature didn't verify", test.Name)
+		}
+
+		if _, err := JWKThumbprint(test.Key, crypto.SHA256); err != nil {
+			t.Errorf("test %q: failed getting thumbprint: %v", test.Name, err)
+		}
+	}
+
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if err := validateAccountKey(small); err == nil {
+		t.Errorf("1024 bit RSA key should not be valid")
+	}
+}
+
+func TestTXTValues(t *testing.T) {
+	values := addTXTValue(nil, "wildcard-token")
+	values = addTXTValue(values, "apex-token")
+	values = addTXTValue(values, "apex-token")
+	if len(values) != 2 || values[0] != "wildcard-token" || values[1] != "apex-token" {
+		t.Fatalf("expected both tokens once, got %v", values)
+	}
+
+	remaining := removeTXTValue(values, "wildcard-token")
+	if len(remaining) != 1 || remaining[0] != "apex-token" {
+		t.Errorf("expected only the apex token to remain, got %v", remaining)
+	}
+	if len(values) != 2 {
+		t.Errorf("removing a value shouldn't modify the original slice, got %v", values)
+	}
+
+	if name := challengeRecordName("*.example.org"); name != "_acme-challenge.example.org" {
+		t.Errorf("expected wildcard to share the apex record name, got %q", name)
+	}
+}
+
+func TestIPIdentifiers(t *testing.T) {
+	tests := []struct {
+		Name               string
+		Identifier         string
+		ExpectedType       string
+		ExpectedValue      string
+		ExpectedServerName string
+	}{
+		{"DNS name", "www.example.org", "dns", "www.example.org", "www.example.org"},
+		{"IPv4", "192.0.2.10", "ip", "192.0.2.10", "10.2.0.192.in-addr.arpa"},
+		{"IPv6", "2001:db8::1", "ip", "2001:db8::1",
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+
+	for _, test := range tests {
+		id := newIdentifier(test.Identifier)
+		if id.Type != test.ExpectedType || id.Value != test.ExpectedValue {
+			t.Errorf("test %q: expected identifier %s/%s, got %s/%s", test.Name, test.ExpectedType, test.ExpectedValue, id.Type, id.Value)
+		}
+		if sni := tlsALPNServerName(test.Identifier); sni != test.ExpectedServerName {
+			t.Errorf("test %q: expected server name %q, got %q", test.Name, test.ExpectedServerName, sni)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Header   string
+		Expected time.Duration
+	}{
+		{"No header", "", defaultPollInterval},
+		{"Seconds", "30", 30 * time.Second},
+		{"Garbage", "soon", defaultPollInterval},
+		{"Date in the past", "Wed, 21 Oct 2015 07:28:00 GMT", 0},
+	}
+
+	for _, test := range tests {
+		h := http.Header{}
+		if test.Header != "" {
+			h.Set("Retry-After", test.Header)
+		}
+		if d := retryAfter(h, defaultPollInterval); d != test.Expected {
+			t.Errorf("test %q: expected %v, got %v", test.Name, test.Expected, d)
+		}
+	}
+
+	h := http.Header{}
+	h.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if d := retryAfter(h, defaultPollInterval); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expected about an hour for a date an hour out, got %v", d)
+	}
+}
+
+func TestFileOrderJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmev2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal := NewFileOrderJournal(dir)
+	dirURL := "https://acme-staging-v02.api.letsencrypt.org/directory"
+	names := []string{"*.example.org", "example.org"}
+
+	order, err := journal.LoadOrder(dirURL, names)
+	if err != nil || order != nil {
+		t.Fatalf("expected no order and no error before saving, got %v, %v", order, err)
+	}
+
+	err = journal.SaveOrder(dirURL, JournaledOrder{
+		Names:    names,
+		OrderURL: "https://example.org/acme/order/1",
+		Finalize: "https://example.org/acme/order/1/finalize",
+		Authorizations: []JournaledAuthorization{
+			{URL: "https://example.org/acme/authz/1", ChallengeType: "dns-01", Token: "token-1"},
+		},
+		DNSRecords: []JournaledTXTRecord{{Domain: "*.example.org", Value: "txt-value"}},
+	})
+	if err != nil {
+		t.Fatalf("failed saving order: %v", err)
+	}
+
+	if other, err := journal.LoadOrder(dirURL, []string{"example.org"}); err != nil || other != nil {
+		t.Errorf("expected no order for other names, got %v, %v", other, err)
+	}
+
+	order, err = journal.LoadOrder(dirURL, names)
+	if err != nil {
+		t.Fatalf("failed loading order: %v", err)
+	}
+	if order.OrderURL != "https://example.org/acme/order/1" {
+		t.Errorf("expected order URL %q, got %q", "https://example.org/acme/order/1", order.OrderURL)
+	}
+	if len(order.Authorizations) != 1 || order.Authorizations[0].Token != "token-1" {
+		t.Errorf("unexpected authorizations %v", order.Authorizations)
+	}
+	if len(order.DNSRecords) != 1 || order.DNSRecords[0].Value != "txt-value" {
+		t.Errorf("unexpected DNS records %v", order.DNSRecords)
+	}
+
+	if err := journal.DeleteOrder(dirURL, names); err != nil {
+		t.Fatalf("failed deleting order: %v", err)
+	}
+	if err := journal.DeleteOrder(dirURL, names); err != nil {
+		t.Errorf("deleting a missing order should not fail: %v", err)
+	}
+	if order, err := journal.LoadOrder(dirURL, names); err != nil || order != nil {
+		t.Errorf("expected no order after deleting, got %v, %v", order, err)
+	}
+}
+
+func TestAuthorizationNeedsChallenge(t *testing.T) {
+	tests := []struct {
+		Status         string
+		NeedsChallenge bool
+		ShouldError    bool
+	}{
+		{StatusPending, true, false},
+		{StatusValid, false, false},
+		{StatusInvalid, false, true},
+		{StatusDeactivated, false, true},
+		{StatusExpired, false, true},
+	}
+
+	for _, test := range tests {
+		authz := ChallengeResponse{Status: test.Status, Identifier: CertIdentifier{"dns", "example.org"}}
+		needsChallenge, err := authz.needsChallenge()
+		if test.ShouldError != (err != nil) {
+			t.Errorf("status %q: expected error %t, got %v", test.Status, test.ShouldError, err)
+		}
+		if needsChallenge != test.NeedsChallenge {
+			t.Errorf("status %q: expected needsChallenge %t, got %t", test.Status, test.NeedsChallenge, needsChallenge)
+		}
+	}
+}
+
+func TestPreAuthorizeRejectsWildcards(t *testing.T) {
+	c := Client{Directory: Directory{NewAuthz: "https://example.org/acme/new-authz"}}
+	if _, err := c.PreAuthorize(context.Background(), "*.example.org"); err == nil {
+		t.Errorf("pre-authorizing a wildcard name should fail")
+	}
+
+	c = Client{}
+	if _, err := c.PreAuthorize(context.Background(), "example.org"); err == nil {
+		t.Errorf("pre-authorizing without a newAuthz URL should fail")
+	}
+}
+
+func TestLinkURLs(t *testing.T) {
+	h := http.Header{}
+	h.Add("Link", `<https://example.org/acme/directory>;rel="index"`)
+	h.Add("Link", `</acme/orders/1?cursor=2>; rel="next", <https://example.org/acme/cert/1/1>;rel="alternate"`)
+	h.Add("Link", `<https://example.org/acme/cert/1/2>;rel=alternate`)
+
+	next := linkURLs(h, "https://example.org/acme/orders/1", "next")
+	if len(next) != 1 || next[0] != "https://example.org/acme/orders/1?cursor=2" {
+		t.Errorf("unexpected next links %v", next)
+	}
+
+	alternates := linkURLs(h, "https://example.org/acme/cert/1", "alternate")
+	if len(alternates) != 2 || alternates[0] != "https://example.org/acme/cert/1/1" || alternates[1] != "https://example.org/acme/cert/1/2" {
+		t.Errorf("unexpected alternate links %v", alternates)
+	}
+
+	if up := linkURLs(h, "https://example.org/acme/cert/1", "up"); len(up) != 0 {
+		t.Errorf("expected no up links, got %v", up)
+	}
+}
+
+func TestRevokeRequest(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	req, cert, err := newRevokeRequest(certPEM, ReasonKeyCompromise)
+	if err != nil {
+		t.Fatalf("failed building revocation request: %v", err)
+	}
+	if req.Certificate != base64.RawURLEncoding.EncodeToString(der) || req.Reason != ReasonKeyCompromise {
+		t.Errorf("unexpected revocation request %+v", req)
+	}
+	if !publicKeysEqual(cert.PublicKey, key.Public()) {
+		t.Errorf("cert key should match the key it was created with")
+	}
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if publicKeysEqual(cert.PublicKey, other.Public()) {
+		t.Errorf("cert key should not match another key")
+	}
+
+	if _, _, err := newRevokeRequest(certPEM, RevocationReason(7)); err == nil {
+		t.Errorf("reason code 7 should not be valid")
+	}
+	if _, _, err := newRevokeRequest([]byte("not a cert"), ReasonUnspecified); err == nil {
+		t.Errorf("expected an error for input without a cert")
+	}
+
+	token, err := jwsEncodeJSONWithJWKNonce(key, req, "https://example.org/acme/revoke-cert", "some-nonce")
+	if err != nil {
+		t.Fatalf("failed encoding JWS: %v", err)
+	}
+	var msg Message
+	if err := json.Unmarshal(token, &msg); err != nil {
+		t.Fatal(err)
+	}
+	phead, _ := base64.RawURLEncoding.DecodeString(msg.Protected)
+	var protected struct {
+		JWK   json.RawMessage `json:"jwk"`
+		Nonce string          `json:"nonce"`
+	}
+	if err := json.Unmarshal(phead, &protected); err != nil {
+		t.Fatal(err)
+	}
+	if protected.Nonce != "some-nonce" || len(protected.JWK) == 0 {
+		t.Errorf("expected the protected header to carry the JWK and nonce, got %s", phead)
+	}
+}
+
+func TestPreferredChain(t *testing.T) {
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Example Root X2"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	leaf := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"example.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, &leaf, &root, leafKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	sum := sha256.Sum256(der)
+
+	tests := []struct {
+		Name     string
+		Pref     PreferredChain
+		Expected bool
+	}{
+		{"Issuer name", PreferredChain{IssuerCommonName: "Example Root X2"}, true},
+		{"Other issuer name", PreferredChain{IssuerCommonName: "Example Root X1"}, false},
+		{"Fingerprint", PreferredChain{CertFingerprint: strings.ToUpper(hex.EncodeToString(sum[:]))}, true},
+		{"Other fingerprint", PreferredChain{CertFingerprint: "00"}, false},
+		{"Both", PreferredChain{IssuerCommonName: "Example Root X2", CertFingerprint: hex.EncodeToString(sum[:])}, true},
+	}
+
+	for _, test := range tests {
+		if matches := test.Pref.matches(chainPEM); matches != test.Expected {
+			t.Errorf("test %q: expected match %t, got %t", test.Name, test.Expected, matches)
+		}
+	}
+
+	if !(PreferredChain{}).IsZero() {
+		t.Errorf("empty preference should be zero")
+	}
+
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		_, _ = w.Write(chainPEM)
+	})
+	defer srv.Close()
+	for _, logger := range []Logger{&logRecorder{}, &warnRecorder{}} {
+		c := newTestClient(srv)
+		c.Logger = logger
+		c.PreferredChain = PreferredChain{IssuerCommonName: "Example Root X1"}
+		if _, err := c.downloadCert(context.Background(), srv.URL+"/cert/1"); err != nil {
+			t.Fatal(err)
+		}
+		var warnings []string
+		switch l := logger.(type) {
+		case *logRecorder:
+			for _, msg := range l.msgs {
+				if strings.HasPrefix(msg, "Warning: No chain matches") {
+					warnings = append(warnings, msg)
+				}
+			}
+		case *warnRecorder:
+			warnings = l.warnings
+		}
+		if len(warnings) != 1 {
+			t.Errorf("expected a warning about the preferred chain from %T, got %v", logger, warnings)
+		}
+	}
+}
+
+type warnRecorder struct {
+	logRecorder
+	warnings []string
+}
+
+func (l *warnRecorder) Warn(msg interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprint(msg))
+}
+
+func TestRenewalInfo(t *testing.T) {
+	// Example from RFC 9773, section 4.1.
+	cert := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3,
+			0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4},
+		SerialNumber: big.NewInt(0x87654321),
+	}
+	certID, err := ARICertID(cert)
+	if err != nil {
+		t.Fatalf("failed getting cert ID: %v", err)
+	}
+	if certID != "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE" {
+		t.Errorf("expected cert ID %q, got %q", "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE", certID)
+	}
+
+	var info RenewalInfo
+	err = json.Unmarshal([]byte(`{
+		"suggestedWindow": {"start": "2025-01-02T04:00:00Z", "end": "2025-01-03T04:00:00Z"},
+		"explanationURL": "https://acme.example.com/docs/ari"
+	}`), &info)
+	if err != nil {
+		t.Fatalf("failed parsing renewal info: %v", err)
+	}
+	start, end := info.SuggestedWindow.Start, info.SuggestedWindow.End
+	if renewAt := info.RenewalTime(start.Add(-time.Hour)); renewAt.Before(start) || !renewAt.Before(end) {
+		t.Errorf("renewal time %s is outside of the window %s to %s", renewAt, start, end)
+	}
+	info.CertID = certID
+	renewAt := info.RenewalTime(start.Add(-time.Hour))
+	if again := info.RenewalTime(start.Add(time.Minute)); !again.Equal(renewAt) {
+		t.Errorf("expected the same renewal time on every check, got %s and %s", renewAt, again)
+	}
+	other := info
+	other.CertID = "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyI"
+	if other.RenewalTime(start.Add(-time.Hour)).Equal(renewAt) {
+		t.Errorf("expected different certs to be spread over the window")
+	}
+	if now := end.Add(time.Hour); !info.RenewalTime(now).Equal(now) {
+		t.Errorf("expected a window that has ended to mean renewing right away")
+	}
+	if info.ShouldRenew(start.Add(-time.Minute)) {
+		t.Errorf("should not renew before the window starts")
+	}
+	if !info.ShouldRenew(start.Add(time.Minute)) {
+		t.Errorf("should renew once the window started")
+	}
+}
+
+func TestCertApplyUnknownProfile(t *testing.T) {
+	c := Client{Directory: Directory{Meta: DirectoryMeta{Profiles: map[string]string{"classic": "", "shortlived": ""}}}}
+	_, err := c.CertApplyWithOptions(context.Background(), []string{"example.org"}, OrderOptions{Profile: "tlsserver"})
+	if err == nil || !strings.Contains(err.Error(), "tlsserver") {
+		t.Errorf("expected an error about the unknown profile, got %v", err)
+	}
+
+	c = Client{}
+	if _, err := c.CertApplyWithOptions(context.Background(), []string{"example.org"}, OrderOptions{Profile: "classic"}); err == nil {
+		t.Errorf("expected an error for a CA without profiles")
+	}
+
+	payload, err := json.Marshal(CertApply{Identifiers: []CertIdentifier{newIdentifier("example.org")}, Profile: "shortlived"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(payload), `"profile":"shortlived"`) {
+		t.Errorf("expected the profile in the order payload, got %s", payload)
+	}
+}
+
+func TestCertApplyValidityWindow(t *testing.T) {
+	now := time.Now()
+	c := Client{}
+	_, err := c.CertApplyWithOptions(context.Background(), []string{"example.org"}, OrderOptions{NotBefore: now, NotAfter: now.Add(-time.Hour)})
+	if err == nil {
+		t.Errorf("expected an error for notAfter before notBefore")
+	}
+
+	payload, err := json.Marshal(CertApply{Identifiers: []CertIdentifier{newIdentifier("example.org")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), "notBefore") || strings.Contains(string(payload), "notAfter") {
+		t.Errorf("expected no validity window in the order payload, got %s", payload)
+	}
+
+	notAfter := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	payload, err = json.Marshal(CertApply{Identifiers: []CertIdentifier{newIdentifier("example.org")}, NotAfter: &notAfter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(payload), `"notAfter":"2026-10-16T12:00:00Z"`) || strings.Contains(string(payload), "notBefore") {
+		t.Errorf("expected only notAfter in the order payload, got %s", payload)
+	}
+
+	var problem string
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, `{"type": "urn:ietf:params:acme:error:%s", "detail": "no"}`, problem)
+	})
+	defer srv.Close()
+	c = newTestClient(srv)
+	for _, test := range []struct {
+		problem string
+		window  bool
+	}{
+		{ProblemMalformed, true},
+		{ProblemRateLimited, false},
+		{ProblemUnauthorized, false},
+	} {
+		problem = test.problem
+		_, err := c.CertApplyWithOptions(context.Background(), []string{"example.org"}, OrderOptions{NotAfter: notAfter})
+		var p *ProblemError
+		if !errors.As(err, &p) || !p.HasType(test.problem) {
+			t.Errorf("expected a %s problem, got %v", test.problem, err)
+		}
+		if strings.Contains(fmt.Sprint(err), "validity window") != test.window {
+			t.Errorf("%s problem blamed on the validity window: %t, expected %t (%v)", test.problem, !test.window, test.window, err)
+		}
+	}
+}
+
+func TestCertApplyAlreadyReplaced(t *testing.T) {
+	var orders []CertApply
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		if req.Path != "/new-order" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var order CertApply
+		if err := json.Unmarshal(req.Payload, &order); err != nil {
+			t.Errorf("bad newOrder payload %s: %v", req.Payload, err)
+		}
+		orders = append(orders, order)
+		if order.Replaces != "" {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"type": "urn:ietf:params:acme:error:alreadyReplaced", "detail": "cert already replaced"}`))
+			return
+		}
+		w.Header().Set("Location", req.Protected.URL+"/1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status": "pending", "finalize": "https://example.org/finalize/1"}`))
+	})
+	defer srv.Close()
+
+	c := newTestClient(srv)
+	order, err := c.CertApplyWithOptions(context.Background(), []string{"example.org"}, OrderOptions{Replaces: "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"})
+	if err != nil {
+		t.Fatalf("expected the order to go through without replaces, got %v", err)
+	}
+	if len(orders) != 2 || orders[0].Replaces == "" || orders[1].Replaces != "" {
+		t.Errorf("expected one order with replaces and one without, got %+v", orders)
+	}
+	if order.Status != StatusPending {
+		t.Errorf("expected the new order, got %+v", order)
+	}
+}
+
+func TestProblemError(t *testing.T) {
+	body := []byte(`{
+		"type": "urn:ietf:params:acme:error:rejectedIdentifier",
+		"detail": "Some of the identifiers requested were rejected",
+		"status": 400,
+		"subproblems": [
+			{
+				"type": "urn:ietf:params:acme:error:caa",
+				"detail": "CAA record for example.org prevents issuance",
+				"identifier": {"type": "dns", "value": "example.org"}
+			}
+		]
+	}`)
+	err := fmt.Errorf("ordering cert: %w", newProblemError(400, http.Header{}, body))
+
+	var problem *ProblemError
+	if !errors.As(err, &problem) {
+		t.Fatalf("expected a *ProblemError, got %T", err)
+	}
+	if problem.Status != 400 || len(problem.Subproblems) != 1 || problem.Subproblems[0].Identifier.Value != "example.org" {
+		t.Errorf("unexpected problem %+v", problem)
+	}
+	if !IsRejectedIdentifier(err) || !IsCAA(err) {
+		t.Errorf("expected a rejectedIdentifier problem with a caa subproblem")
+	}
+	if IsDNS(err) || IsBadNonce(err) || IsRateLimited(err) {
+		t.Errorf("problem should not match other types")
+	}
+	if !strings.Contains(err.Error(), "caa for example.org") {
+		t.Errorf("expected the subproblem in the error message, got %q", err.Error())
+	}
+
+	plain := newProblemError(502, http.Header{}, []byte("<html>Bad Gateway</html>"))
+	if plain.Status != 502 || plain.Detail != "<html>Bad Gateway</html>" || plain.Type != "" {
+		t.Errorf("unexpected problem for a non-problem body %+v", plain)
+	}
+	if IsServerInternal(plain) || IsBadNonce(errors.New("badNonce")) {
+		t.Errorf("problems without a matching type should not match")
+	}
+
+	authz := ChallengeResponse{
+		Status:     StatusInvalid,
+		Identifier: CertIdentifier{"dns", "www.example.org"},
+		Challenges: []Challenge{
+			{Type: "dns-01", Status: StatusInvalid, Error: &ProblemError{Type: "urn:ietf:params:acme:error:dns", Detail: "NXDOMAIN"}},
+		},
+	}
+	_, err = authz.needsChallenge()
+	if !IsDNS(err) || !errors.As(err, &problem) || problem.Identifier == nil || problem.Identifier.Value != "www.example.org" {
+		t.Errorf("expected a dns problem for www.example.org, got %v", err)
+	}
+}
+
+func TestNoncePool(t *testing.T) {
+	var p noncePool
+	if _, ok := p.get(); ok {
+		t.Fatalf("empty pool should not hand out nonces")
+	}
+	for i := 0; i < maxPooledNonces+2; i++ {
+		p.put(fmt.Sprintf("nonce-%d", i))
+	}
+	p.put("")
+
+	nonce, ok := p.get()
+	if !ok || nonce != fmt.Sprintf("nonce-%d", maxPooledNonces+1) {
+		t.Errorf("expected the most recent nonce, got %q", nonce)
+	}
+	count := 1
+	for _, ok := p.get(); ok; _, ok = p.get() {
+		count++
+	}
+	if count != maxPooledNonces {
+		t.Errorf("expected the pool to hold %d nonces, got %d", maxPooledNonces, count)
+	}
+}
+
+func TestBadNonceRetry(t *testing.T) {
+	var posts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Replay-Nonce", "stale")
+			return
+		}
+		var msg Message
+		_ = json.NewDecoder(r.Body).Decode(&msg)
+		phead, _ := base64.RawURLEncoding.DecodeString(msg.Protected)
+		var protected struct {
+			Nonce string `json:"nonce"`
+		}
+		_ = json.Unmarshal(phead, &protected)
+		posts = append(posts, protected.Nonce)
+
+		if protected.Nonce == "stale" {
+			w.Header().Set("Replay-Nonce", "fresh")
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"type": "urn:ietf:params:acme:error:badNonce", "detail": "JWS has an invalid anti-replay nonce"}`))
+			return
+		}
+		w.Header().Set("Replay-Nonce", "next")
+		_, _ = w.Write([]byte(`{"status": "valid"}`))
+	}))
+	defer srv.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c := Client{Key: key, KID: srv.URL + "/acct/1", Directory: Directory{NewNonce: srv.URL + "/new-nonce"}}
+
+	order, err := c.FetchOrder(context.Background(), srv.URL+"/order/1")
+	if err != nil {
+		t.Fatalf("request should have been retried with a fresh nonce: %v", err)
+	}
+	if order.Status != StatusValid {
+		t.Errorf("unexpected order status %q", order.Status)
+	}
+	if len(posts) != 2 || posts[0] != "stale" || posts[1] != "fresh" {
+		t.Errorf("expected a retry with the nonce from the badNonce response, got nonces %v", posts)
+	}
+	if nonce, _ := c.nonces.get(); nonce != "next" {
+		t.Errorf("expected the last Replay-Nonce to be pooled, got %q", nonce)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmev2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ledger := NewFileIssuanceLedger(dir)
+	c := Client{
+		DirectoryURL:   "https://acme-v02.api.letsencrypt.org/directory",
+		IssuanceLedger: ledger,
+		RateLimits:     RateLimits{CertsPerRegisteredDomain: 3, DuplicateCerts: 2, Window: 7 * 24 * time.Hour},
+	}
+
+	for _, names := range [][]string{{"a.example.org"}, {"b.example.org"}, {"c.example.org", "example.org"}} {
+		if err := c.checkRateLimits(names); err != nil {
+			t.Fatalf("issuing for %v should be within limits: %v", names, err)
+		}
+		if err := c.recordIssuance(names); err != nil {
+			t.Fatalf("failed recording issuance: %v", err)
+		}
+	}
+
+	err = c.checkRateLimits([]string{"d.example.org"})
+	if !IsRateLimited(err) {
+		t.Fatalf("expected the registered domain limit to be hit, got %v", err)
+	}
+	if reset, ok := RateLimitReset(err); !ok || reset.Before(time.Now().Add(6*24*time.Hour)) {
+		t.Errorf("expected the limit to reset in about a week, got %v", reset)
+	}
+
+	if err := c.checkRateLimits([]string{"www.example.net"}); err != nil {
+		t.Errorf("other registered domains should not be limited: %v", err)
+	}
+	if err := c.checkRateLimits([]string{"example.org", "C.example.org"}); err != nil {
+		t.Errorf("renewals should not count against the registered domain limit: %v", err)
+	}
+
+	if err := c.recordIssuance([]string{"a.example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkRateLimits([]string{"a.example.org"}); !IsRateLimited(err) {
+		t.Errorf("expected the duplicate cert limit to be hit, got %v", err)
+	}
+
+	h := http.Header{}
+	h.Set("Retry-After", "3600")
+	problem := newProblemError(429, h, []byte(`{"type": "urn:ietf:params:acme:error:rateLimited", "detail": "too many certificates"}`))
+	if reset, ok := RateLimitReset(problem); !ok || reset.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("expected the CA's limit to reset in about an hour, got %v", reset)
+	}
+	if _, ok := RateLimitReset(errors.New("something else")); ok {
+		t.Errorf("other errors should not have a rate limit reset")
+	}
+	for _, v := range []string{"", "soon"} {
+		h := http.Header{}
+		if v != "" {
+			h.Set("Retry-After", v)
+		}
+		problem := newProblemError(429, h, []byte(`{"type": "urn:ietf:params:acme:error:rateLimited"}`))
+		if reset, ok := RateLimitReset(problem); ok {
+			t.Errorf("Retry-After %q should not give a rate limit reset, got %v", v, reset)
+		}
+	}
+
+	// Limits that only set counts still apply to the default window.
+	c.RateLimits = RateLimits{DuplicateCerts: 1}
+	if err := c.checkRateLimits([]string{"a.example.org"}); !IsRateLimited(err) {
+		t.Errorf("expected the duplicate cert limit to be hit without a Window, got %v", err)
+	}
+}
+
+func TestClientUsesHTTPClientAndContext(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/directory":
+			_, _ = fmt.Fprintf(w, `{"newNonce": %q, "newOrder": %q}`, srv.URL+"/new-nonce", srv.URL+"/new-order")
+		case "/new-nonce":
+			w.Header().Set("Replay-Nonce", "nonce")
+		default:
+			w.Header().Set("Replay-Nonce", "nonce")
+			_, _ = w.Write([]byte(`{"status": "pending"}`))
+		}
+	}))
+	defer srv.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := NewClient(srv.URL+"/directory", nil, nil, ClientOpts{AccountKey: key}); err == nil {
+		t.Fatalf("the default client should not trust the test server's cert")
+	}
+
+	c, err := NewClient(srv.URL+"/directory", nil, nil, ClientOpts{AccountKey: key, HTTPClient: srv.Client()})
+	if err != nil {
+		t.Fatalf("failed creating client with the test server's HTTP client: %v", err)
+	}
+	if c.Directory.NewOrder != srv.URL+"/new-order" {
+		t.Errorf("unexpected directory %+v", c.Directory)
+	}
+	c.KID = srv.URL + "/acct/1"
+
+	if order, err := c.FetchOrder(context.Background(), srv.URL+"/order/1"); err != nil || order.Status != StatusPending {
+		t.Fatalf("expected a pending order, got %+v, %v", order, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.FetchOrder(ctx, srv.URL+"/order/1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request to be canceled, got %v", err)
+	}
+}
+
+type logRecorder struct {
+	msgs []string
+}
+
+func (l *logRecorder) Log(msg interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprint(msg))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := ExponentialBackoff{MaxAttempts: 3, InitialInterval: time.Second, MaxInterval: 3 * time.Second, MaxElapsed: time.Minute}
+	unavailable := &ProblemError{Status: http.StatusServiceUnavailable, Header: http.Header{}}
+	internal := &ProblemError{Type: problemTypePrefix + ProblemServerInternal, Status: http.StatusInternalServerError}
+	reset := fmt.Errorf("post failed: %w", io.ErrUnexpectedEOF)
+	refused := &url.Error{Op: "Post", URL: "https://ca.example/new-order", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+
+	tests := []struct {
+		kind    RequestKind
+		attempt int
+		elapsed time.Duration
+		err     error
+		delay   time.Duration
+		retry   bool
+	}{
+		{RequestFetch, 1, 0, reset, time.Second, true},
+		{RequestFetch, 2, 0, internal, 2 * time.Second, true},
+		{RequestFetch, 3, 0, internal, 0, false},
+		{RequestFetch, 1, 59500 * time.Millisecond, reset, 0, false},
+		{RequestIdempotent, 1, 0, reset, time.Second, true},
+		{RequestFetch, 1, 0, &ProblemError{Type: problemTypePrefix + ProblemBadNonce, Status: 400}, 0, false},
+		{RequestFetch, 1, 0, &ProblemError{Type: problemTypePrefix + ProblemRateLimited, Status: 429}, 0, false},
+		{RequestFetch, 1, 0, context.Canceled, 0, false},
+		{RequestNonIdempotent, 1, 0, reset, 0, false},
+		{RequestNonIdempotent, 1, 0, internal, 0, false},
+		{RequestNonIdempotent, 1, 0, unavailable, time.Second, true},
+		{RequestNonIdempotent, 1, 0, &ProblemError{Status: http.StatusBadGateway}, 0, false},
+		{RequestNonIdempotent, 1, 0, &ProblemError{Status: http.StatusGatewayTimeout}, 0, false},
+		{RequestNonIdempotent, 1, 0, refused, time.Second, true},
+		{RequestNoRetry, 1, 0, unavailable, 0, false},
+		{RequestNoRetry, 1, 0, refused, 0, false},
+	}
+	for _, test := range tests {
+		delay, retry := policy.Backoff(test.kind, test.attempt, test.elapsed, test.err)
+		if delay != test.delay || retry != test.retry {
+			t.Errorf("Backoff(%s, %d, %s, %v) = %s, %t, expected %s, %t", test.kind, test.attempt, test.elapsed, test.err, delay, retry, test.delay, test.retry)
+		}
+	}
+
+	policy.MaxAttempts = 10
+	if delay, _ := policy.Backoff(RequestFetch, 5, 0, reset); delay != 3*time.Second {
+		t.Errorf("expected the delay to be capped at MaxInterval, got %s", delay)
+	}
+	unavailable.Header.Set("Retry-After", "10")
+	if delay, _ := policy.Backoff(RequestFetch, 1, 0, unavailable); delay != 10*time.Second {
+		t.Errorf("expected Retry-After to be honored, got %s", delay)
+	}
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay, _ := policy.Backoff(RequestFetch, 1, 0, reset); delay < 500*time.Millisecond || delay > 1500*time.Millisecond {
+			t.Fatalf("jittered delay %s out of range", delay)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var nonces []string
+	issued := 0
+	failures := map[string]int{"/order/1": 1, "/new-order": 1, "/finalize/1": 1}
+	orderStatus := StatusReady
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issued++
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", issued))
+		if r.Method == "HEAD" {
+			return
+		}
+		var msg Message
+		_ = json.NewDecoder(r.Body).Decode(&msg)
+		phead, _ := base64.RawURLEncoding.DecodeString(msg.Protected)
+		var protected struct {
+			Nonce string `json:"nonce"`
+		}
+		_ = json.Unmarshal(phead, &protected)
+		nonces = append(nonces, protected.Nonce)
+
+		switch {
+		case r.URL.Path == "/finalize/1" && failures[r.URL.Path] > 0:
+			// The CA gets the request but the connection is reset before the response makes it back.
+			failures[r.URL.Path]--
+			orderStatus = StatusProcessing
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		case failures[r.URL.Path] > 0:
+			failures[r.URL.Path]--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"status": %q}`, orderStatus)
+	}))
+	defer srv.Close()
+
+	logger := &logRecorder{}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c := Client{
+		Key:         key,
+		KID:         srv.URL + "/acct/1",
+		Directory:   Directory{NewNonce: srv.URL + "/new-nonce", NewOrder: srv.URL + "/new-order"},
+		OrderURL:    srv.URL + "/order/1",
+		Finalize:    srv.URL + "/finalize/1",
+		Logger:      logger,
+		RetryPolicy: ExponentialBackoff{MaxAttempts: 3, InitialInterval: time.Millisecond},
+	}
+
+	order, err := c.FetchOrder(context.Background(), c.OrderURL)
+	if err != nil {
+		t.Fatalf("fetching the order should have been retried: %v", err)
+	}
+	if order.Status != StatusReady {
+		t.Errorf("unexpected order status %q", order.Status)
+	}
+	if len(nonces) != 2 || nonces[0] == nonces[1] {
+		t.Errorf("expected the retry to use a new nonce, got nonces %v", nonces)
+	}
+	retried := false
+	for _, msg := range logger.msgs {
+		retried = retried || strings.Contains(msg, "Attempt 1 of fetch request to "+c.OrderURL)
+	}
+	if !retried {
+		t.Errorf("expected the retry to be logged, got %v", logger.msgs)
+	}
+
+	nonces = nil
+	if _, err := c.CertApply(context.Background(), []string{"example.org"}); !IsTransient(err) {
+		t.Errorf("expected the newOrder error, got %v", err)
+	}
+	if len(nonces) != 1 {
+		t.Errorf("newOrder failing with a 500 must not be sent again, got %d requests", len(nonces))
+	}
+
+	nonces = nil
+	order, err = c.finalize(context.Background(), []byte("csr"))
+	if err != nil {
+		t.Fatalf("finalize should have found the order processing: %v", err)
+	}
+	if order.Status != StatusProcessing {
+		t.Errorf("unexpected order status %q", order.Status)
+	}
+	if len(nonces) != 2 {
+		t.Errorf("expected one finalize and one order fetch, got %d requests", len(nonces))
+	}
+}
+
+// testRequest is a JWS request as received by a server from newTestACMEServer.
+type testRequest struct {
+	Path      string
+	Msg       Message
+	Protected struct {
+		Alg   string          `json:"alg"`
+		KID   string          `json:"kid"`
+		JWK   json.RawMessage `json:"jwk"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+	}
+	Payload []byte
+}
+
+// newTestACMEServer starts a server that hands out a new nonce with every response, serves the same
+// directory as newTestClient uses at /directory and passes the decoded JWS requests POSTed to it to
+// handle.
+func newTestACMEServer(t *testing.T, handle func(w http.ResponseWriter, req testRequest)) *httptest.Server {
+	var mu sync.Mutex
+	nonces := 0
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		nonces++
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", nonces))
+		if r.Method == "HEAD" {
+			return
+		}
+		if r.Method == "GET" && r.URL.Path == "/directory" {
+			_ = json.NewEncoder(w).Encode(newTestClient(srv).Directory)
+			return
+		}
+
+		req := testRequest{Path: r.URL.Path}
+		if err := json.NewDecoder(r.Body).Decode(&req.Msg); err != nil {
+			t.Errorf("request to %s is not a JWS: %v", r.URL.Path, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		phead, _ := base64.RawURLEncoding.DecodeString(req.Msg.Protected)
+		if err := json.Unmarshal(phead, &req.Protected); err != nil {
+			t.Errorf("request to %s has a bad protected header: %v", r.URL.Path, err)
+		}
+		req.Payload, _ = base64.RawURLEncoding.DecodeString(req.Msg.Payload)
+		handle(w, req)
+	}))
+	return srv
+}
+
+// newTestClient returns a client with a fresh account key talking to srv, with retries turned off.
+func newTestClient(srv *httptest.Server) Client {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return Client{
+		Key: key,
+		KID: srv.URL + "/acct/1",
+		Directory: Directory{
+			NewNonce:   srv.URL + "/new-nonce",
+			NewAccount: srv.URL + "/new-account",
+			NewOrder:   srv.URL + "/new-order",
+			NewAuthz:   srv.URL + "/new-authz",
+			RevokeCert: srv.URL + "/revoke-cert",
+			KeyChange:  srv.URL + "/key-change",
+		},
+		RetryPolicy: ExponentialBackoff{MaxAttempts: 1},
+	}
+}
+
+// recordingDNS is a DNSModifier remembering the TXT records added and removed, as "domain value".
+type recordingDNS struct {
+	added   []string
+	removed []string
+}
+
+func (d *recordingDNS) AddTextRecord(domain, token string) error {
+	d.added = append(d.added, domain+" "+token)
+	return nil
+}
+
+func (d *recordingDNS) RemoveTextRecord(domain, token string) error {
+	d.removed = append(d.removed, domain+" "+token)
+	return nil
+}
+
+func TestResumedOrderRemovesJournaledTXTRecords(t *testing.T) {
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		switch req.Path {
+		case "/order/1":
+			base := strings.TrimSuffix(req.Protected.URL, req.Path)
+			_, _ = fmt.Fprintf(w, `{"status": "ready", "authorizations": [%q], "finalize": %q}`, base+"/authz/1", base+"/finalize/1")
+		case "/authz/1":
+			_, _ = w.Write([]byte(`{"status": "valid", "identifier": {"type": "dns", "value": "example.org"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "acmev2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dns := &recordingDNS{}
+	c := newTestClient(srv)
+	c.DNS = dns
+	c.DirectoryURL = srv.URL + "/directory"
+	c.OrderJournal = NewFileOrderJournal(dir)
+	names := []string{"example.org"}
+	err = c.OrderJournal.SaveOrder(c.DirectoryURL, JournaledOrder{
+		Names:          names,
+		OrderURL:       srv.URL + "/order/1",
+		Finalize:       srv.URL + "/finalize/1",
+		Authorizations: []JournaledAuthorization{{URL: srv.URL + "/authz/1", ChallengeType: "dns-01"}},
+		DNSRecords:     []JournaledTXTRecord{{Domain: "example.org", Value: "txt-value"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order, resumed, err := c.resumeOrder(context.Background(), names)
+	if err != nil || !resumed {
+		t.Fatalf("expected the journaled order to be resumed, got %t, %v", resumed, err)
+	}
+	if err := c.authorize(context.Background(), order.Authorizations); err != nil {
+		t.Fatalf("authorizing failed: %v", err)
+	}
+	if len(dns.removed) != 0 {
+		t.Errorf("TXT records removed before the order is done: %v", dns.removed)
+	}
+	if err := c.finishOrder(names); err != nil {
+		t.Fatalf("finishing the order failed: %v", err)
+	}
+
+	if len(dns.added) != 0 {
+		t.Errorf("no challenge should have been solved for a valid authorization, added %v", dns.added)
+	}
+	if len(dns.removed) != 1 || dns.removed[0] != "example.org txt-value" {
+		t.Errorf("expected the journaled TXT record to be removed, removed %v", dns.removed)
+	}
+	if journaled, err := c.OrderJournal.LoadOrder(c.DirectoryURL, names); err != nil || journaled != nil {
+		t.Errorf("expected the journal entry to be gone, got %v, %v", journaled, err)
+	}
+}
+
+func TestRolloverAccountKey(t *testing.T) {
+	var outer, inner testRequest
+	fail := false
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		if req.Path != "/key-change" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		outer = req
+		inner = testRequest{}
+		if err := json.Unmarshal(req.Payload, &inner.Msg); err != nil {
+			t.Errorf("keyChange payload is not a JWS: %v", err)
+		}
+		phead, _ := base64.RawURLEncoding.DecodeString(inner.Msg.Protected)
+		_ = json.Unmarshal(phead, &inner.Protected)
+		inner.Payload, _ = base64.RawURLEncoding.DecodeString(inner.Msg.Payload)
+
+		if fail {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"type": "urn:ietf:params:acme:error:malformed", "detail": "key in use"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "valid"}`))
+	})
+	defer srv.Close()
+
+	c := newTestClient(srv)
+	oldKey := c.Key
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	rolled, err := c.RolloverAccountKey(context.Background(), newKey)
+	if err != nil {
+		t.Fatalf("rollover failed: %v", err)
+	}
+	if rolled != newKey || c.Key != newKey {
+		t.Errorf("expected the client to use the new key after a rollover")
+	}
+
+	if outer.Protected.KID != c.KID || outer.Protected.Nonce == "" || len(outer.Protected.JWK) != 0 || outer.Protected.URL != c.Directory.KeyChange {
+		t.Errorf("outer JWS must be signed by KID with a nonce, got %+v", outer.Protected)
+	}
+	if !verifyJWS(outer.Msg, oldKey.Public()) {
+		t.Errorf("outer JWS must be signed with the old key")
+	}
+
+	newJWK, _ := jwkEncode(newKey.Public())
+	if string(inner.Protected.JWK) != newJWK || inner.Protected.Nonce != "" || inner.Protected.KID != "" || inner.Protected.URL != c.Directory.KeyChange {
+		t.Errorf("inner JWS must carry the new key's JWK and no nonce or KID, got %+v", inner.Protected)
+	}
+	if !verifyJWS(inner.Msg, newKey.Public()) {
+		t.Errorf("inner JWS must be signed with the new key")
+	}
+	var change KeyChange
+	if err := json.Unmarshal(inner.Payload, &change); err != nil {
+		t.Fatal(err)
+	}
+	oldJWK, _ := jwkEncode(oldKey.Public())
+	if change.Account != c.KID || string(change.OldKey) != oldJWK {
+		t.Errorf("expected the inner payload to hold the account and old key, got %s", inner.Payload)
+	}
+
+	// The AccountStore's directory is a file, so saving the account fails.
+	storeFile, err := ioutil.TempFile("", "acmev2-accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = storeFile.Close()
+	defer func() { _ = os.Remove(storeFile.Name()) }()
+	c.AccountStore = NewFileAccountStore(storeFile.Name())
+	rolled, err = c.RolloverAccountKey(context.Background(), nil)
+	var notPersisted *KeyNotPersistedError
+	if !errors.As(err, &notPersisted) {
+		t.Fatalf("expected a KeyNotPersistedError, got %v", err)
+	}
+	if rolled == nil || c.Key != rolled {
+		t.Errorf("expected the generated key to be returned and used even though it wasn't persisted")
+	}
+	c.AccountStore = nil
+
+	fail = true
+	current := c.Key
+	rolled, err = c.RolloverAccountKey(context.Background(), nil)
+	if err == nil {
+		t.Fatalf("expected the rollover to fail")
+	}
+	if errors.As(err, &notPersisted) {
+		t.Errorf("a rejected rollover must not be reported as a persisting failure")
+	}
+	if rolled == nil {
+		t.Errorf("expected the generated key to be returned once the keyChange request was sent")
+	}
+	if c.Key != current {
+		t.Errorf("the client's key must not change when the rollover fails")
+	}
+}
+
+func TestExternalAccountBinding(t *testing.T) {
+	hmacKey := []byte("this is a 32 byte long hmac key!!")
+	for _, encoded := range []string{
+		base64.RawURLEncoding.EncodeToString(hmacKey),
+		base64.URLEncoding.EncodeToString(hmacKey),
+		" " + base64.URLEncoding.EncodeToString(hmacKey) + "\n",
+	} {
+		decoded, err := decodeEABKey(encoded)
+		if err != nil || string(decoded) != string(hmacKey) {
+			t.Errorf("decodeEABKey(%q) = %q, %v, expected the HMAC key", encoded, decoded, err)
+		}
+	}
+	if _, err := decodeEABKey(""); err == nil {
+		t.Errorf("expected an empty HMAC key to be rejected")
+	}
+	if _, err := decodeEABKey("not+base64url/"); err == nil {
+		t.Errorf("expected a standard base64 HMAC key to be rejected")
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	url := "https://example.org/acme/new-account"
+	eab, err := jwsEncodeEAB(key.Public(), "kid-1", hmacKey, url)
+	if err != nil {
+		t.Fatalf("failed encoding EAB: %v", err)
+	}
+
+	var msg Message
+	if err := json.Unmarshal(eab, &msg); err != nil {
+		t.Fatal(err)
+	}
+	phead, _ := base64.RawURLEncoding.DecodeString(msg.Protected)
+	var protected map[string]interface{}
+	if err := json.Unmarshal(phead, &protected); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"alg": "HS256", "kid": "kid-1", "url": url}
+	if len(protected) != len(expected) {
+		t.Errorf("unexpected EAB protected header %s", phead)
+	}
+	for k, v := range expected {
+		if protected[k] != v {
+			t.Errorf("expected EAB header %s to be %q, got %v", k, v, protected[k])
+		}
+	}
+
+	payload, _ := base64.RawURLEncoding.DecodeString(msg.Payload)
+	jwk, _ := jwkEncode(key.Public())
+	if string(payload) != jwk {
+		t.Errorf("expected the EAB payload to be the account JWK %s, got %s", jwk, payload)
+	}
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(msg.Protected + "." + msg.Payload))
+	if sig, _ := base64.RawURLEncoding.DecodeString(msg.Signature); !hmac.Equal(sig, mac.Sum(nil)) {
+		t.Errorf("EAB MAC doesn't match")
+	}
+}
+
+func TestAccountEndpoints(t *testing.T) {
+	var requests []testRequest
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		requests = append(requests, req)
+		base := strings.TrimSuffix(req.Protected.URL, req.Path)
+		switch req.Path {
+		case "/new-account":
+			w.Header().Set("Location", base+"/acct/1")
+			_, _ = w.Write([]byte(`{"status": "valid", "contact": ["mailto:old@example.org"]}`))
+		case "/acct/1":
+			var update AccountUpdate
+			_ = json.Unmarshal(req.Payload, &update)
+			status := "valid"
+			if update.Status != "" {
+				status = update.Status
+			}
+			contacts, _ := json.Marshal(update.Contact)
+			_, _ = fmt.Fprintf(w, `{"status": %q, "contact": %s, "orders": %q}`, status, contacts, base+"/acct/1/orders")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "acmev2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(srv)
+	c.KID = ""
+	c.DirectoryURL = srv.URL + "/directory"
+	c.AccountStore = NewFileAccountStore(dir)
+	ctx := context.Background()
+
+	acct, err := c.LookupAccount(ctx)
+	if err != nil {
+		t.Fatalf("looking up the account failed: %v", err)
+	}
+	req := requests[len(requests)-1]
+	var lookup NewAccount
+	_ = json.Unmarshal(req.Payload, &lookup)
+	if !lookup.OnlyReturnExisting || lookup.TermsOfServiceAgreed || len(lookup.Contact) != 0 {
+		t.Errorf("expected an onlyReturnExisting lookup, got %s", req.Payload)
+	}
+	if len(req.Protected.JWK) == 0 || req.Protected.KID != "" {
+		t.Errorf("account lookup must be signed with the JWK, got %+v", req.Protected)
+	}
+	if c.KID != srv.URL+"/acct/1" || acct.URL != c.KID {
+		t.Errorf("expected the KID to be taken from the Location header, got %q", c.KID)
+	}
+
+	acct, err = c.FetchAccount(ctx)
+	if err != nil {
+		t.Fatalf("fetching the account failed: %v", err)
+	}
+	req = requests[len(requests)-1]
+	if req.Msg.Payload != "" || req.Protected.KID != c.KID || len(req.Protected.JWK) != 0 {
+		t.Errorf("expected a POST-as-GET with an empty payload signed by KID, got payload %q and header %+v", req.Msg.Payload, req.Protected)
+	}
+	if acct.Orders != srv.URL+"/acct/1/orders" {
+		t.Errorf("unexpected orders URL %q", acct.Orders)
+	}
+
+	acct, err = c.UpdateAccountContacts(ctx, []string{"new@example.org"})
+	if err != nil {
+		t.Fatalf("updating contacts failed: %v", err)
+	}
+	req = requests[len(requests)-1]
+	if string(req.Payload) != `{"contact":["mailto:new@example.org"]}` {
+		t.Errorf("unexpected contacts update %s", req.Payload)
+	}
+	if len(c.ContactEmails) != 1 || c.ContactEmails[0] != "mailto:new@example.org" {
+		t.Errorf("expected the client's contacts to be updated, got %v", c.ContactEmails)
+	}
+	if stored, err := c.AccountStore.LoadAccount(c.DirectoryURL); err != nil || stored == nil || len(stored.Contacts) != 1 || stored.Contacts[0] != "mailto:new@example.org" {
+		t.Errorf("expected the new contacts to be stored, got %+v, %v", stored, err)
+	}
+
+	acct, err = c.DeactivateAccount(ctx)
+	if err != nil {
+		t.Fatalf("deactivating the account failed: %v", err)
+	}
+	req = requests[len(requests)-1]
+	if string(req.Payload) != `{"status":"deactivated"}` || acct.Status != StatusDeactivated {
+		t.Errorf("unexpected deactivation %s, account is %q", req.Payload, acct.Status)
+	}
+	stored, err := c.AccountStore.LoadAccount(c.DirectoryURL)
+	if err != nil || stored == nil || !stored.Deactivated {
+		t.Fatalf("expected the stored account to be marked deactivated, got %+v, %v", stored, err)
+	}
+
+	next, err := NewClient(c.DirectoryURL, nil, nil, ClientOpts{AccountStore: c.AccountStore})
+	if err != nil {
+		t.Fatalf("failed creating client: %v", err)
+	}
+	if next.KID != "" || publicKeysEqual(next.Key.Public(), c.Key.Public()) {
+		t.Errorf("a deactivated account must not be used again, got KID %q", next.KID)
+	}
+}
+
+// recordingHTTP is an HTTPResponder remembering the tokens it was asked to serve.
+type recordingHTTP struct {
+	added   []string
+	removed []string
+}
+
+func (h *recordingHTTP) AddChallengeResponse(token, keyAuth string) error {
+	h.added = append(h.added, token)
+	return nil
+}
+
+func (h *recordingHTTP) RemoveChallengeResponse(token string) error {
+	h.removed = append(h.removed, token)
+	return nil
+}
+
+// recordingCertStore is a CertStoreRetriever remembering the certs stored.
+type recordingCertStore struct {
+	stored map[string]string
+	keys   map[string]string
+}
+
+func (s *recordingCertStore) Store(keyPEM, certPEM, domain string) error {
+	if s.stored == nil {
+		s.stored = make(map[string]string)
+		s.keys = make(map[string]string)
+	}
+	s.stored[domain] = certPEM
+	s.keys[domain] = keyPEM
+	return nil
+}
+
+func (s *recordingCertStore) Retrieve(domain string) (string, string, error) {
+	return "", s.stored[domain], nil
+}
+
+func TestMultiNameOrder(t *testing.T) {
+	names := []string{"example.org", "www.example.org", "192.0.2.1"}
+	valid := make(map[int]bool)
+	challenged := make(map[int]int)
+	var csr *x509.CertificateRequest
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		base := strings.TrimSuffix(req.Protected.URL, req.Path)
+		var i int
+		switch {
+		case req.Path == "/new-order":
+			var order CertApply
+			_ = json.Unmarshal(req.Payload, &order)
+			if len(order.Identifiers) != len(names) {
+				t.Errorf("expected an identifier per name, got %v", order.Identifiers)
+			}
+			w.Header().Set("Location", base+"/order/1")
+			w.WriteHeader(http.StatusCreated)
+			fallthrough
+		case req.Path == "/order/1":
+			status := StatusReady
+			for i := range names {
+				if !valid[i] {
+					status = StatusPending
+				}
+			}
+			if csr != nil {
+				status = StatusValid
+			}
+			_, _ = fmt.Fprintf(w, `{"status": %q, "authorizations": [%q, %q, %q], "finalize": %q, "certificate": %q}`,
+				status, base+"/authz/0", base+"/authz/1", base+"/authz/2", base+"/finalize/1", base+"/cert/1")
+		case sscanf(req.Path, "/authz/%d", &i) == 1:
+			status := StatusPending
+			if valid[i] {
+				status = StatusValid
+			}
+			_, _ = fmt.Fprintf(w, `{"status": %q, "identifier": %s, "challenges": [{"type": "http-01", "url": %q, "token": "token-%d"}]}`,
+				status, mustJSON(newIdentifier(names[i])), fmt.Sprintf("%s/chall/%d", base, i), i)
+		case sscanf(req.Path, "/chall/%d", &i) == 1:
+			challenged[i]++
+			valid[i] = true
+			_, _ = w.Write([]byte(`{"status": "processing"}`))
+		case req.Path == "/finalize/1":
+			var finalize CSRRequest
+			_ = json.Unmarshal(req.Payload, &finalize)
+			der, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+			var err error
+			if csr, err = x509.ParseCertificateRequest(der); err != nil {
+				t.Errorf("bad CSR: %v", err)
+			}
+			_, _ = w.Write([]byte(`{"status": "processing"}`))
+		case req.Path == "/cert/1":
+			_, _ = w.Write([]byte("-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "acmev2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// PollForStatus writes cert.crt to the working directory.
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	responder := &recordingHTTP{}
+	store := &recordingCertStore{}
+	c := newTestClient(srv)
+	c.HTTP = responder
+	c.CertsManager = store
+	// The cert key can't be exported, like one living in an HSM.
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.CertKey = opaqueSigner{certKey}
+	ctx := context.Background()
+
+	order, err := c.CertApply(ctx, names)
+	if err != nil {
+		t.Fatalf("ordering failed: %v", err)
+	}
+	if err := c.authorize(ctx, order.Authorizations); err != nil {
+		t.Fatalf("authorizing failed: %v", err)
+	}
+	for i := range names {
+		if challenged[i] != 1 {
+			t.Errorf("expected one challenge for %s, got %d", names[i], challenged[i])
+		}
+	}
+	if len(responder.added) != len(names) || len(responder.removed) != len(names) {
+		t.Errorf("expected a challenge response per authorization to be added and removed, got %v and %v", responder.added, responder.removed)
+	}
+
+	if err := c.PollForStatus(ctx, names...); err != nil {
+		t.Fatalf("polling failed: %v", err)
+	}
+	if csr == nil {
+		t.Fatalf("order was never finalized")
+	}
+	if len(csr.DNSNames) != 2 || csr.DNSNames[0] != "example.org" || csr.DNSNames[1] != "www.example.org" {
+		t.Errorf("expected the CSR to carry both DNS names, got %v", csr.DNSNames)
+	}
+	if len(csr.IPAddresses) != 1 || csr.IPAddresses[0].String() != "192.0.2.1" {
+		t.Errorf("expected the CSR to carry the IP address, got %v", csr.IPAddresses)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Errorf("expected the CSR to be signed by the opaque cert key: %v", err)
+	}
+	if pub, ok := csr.PublicKey.(*ecdsa.PublicKey); !ok || pub.X.Cmp(certKey.X) != 0 || pub.Y.Cmp(certKey.Y) != 0 {
+		t.Errorf("expected the CSR to carry the cert key's public key, got %v", csr.PublicKey)
+	}
+	if store.stored["example.org"] == "" {
+		t.Errorf("expected the cert to be stored under the first name, got %v", store.stored)
+	}
+	if store.keys["example.org"] != "" {
+		t.Errorf("expected no key PEM for a key that can't be exported, got %q", store.keys["example.org"])
+	}
+}
+
+// sscanf reports how many values fmt.Sscanf managed to parse.
+func sscanf(str, format string, a ...interface{}) int {
+	n, _ := fmt.Sscanf(str, format, a...)
+	return n
+}
+
+func mustJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func TestNewAccountTermsOfService(t *testing.T) {
+	exists := false
+	var created []NewAccount
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		if req.Path != "/new-account" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var newAcct NewAccount
+		_ = json.Unmarshal(req.Payload, &newAcct)
+		w.Header().Set("Location", strings.TrimSuffix(req.Protected.URL, req.Path)+"/acct/1")
+		switch {
+		case exists:
+			_, _ = w.Write([]byte(`{"status": "valid"}`))
+		case newAcct.OnlyReturnExisting:
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"type": "urn:ietf:params:acme:error:accountDoesNotExist", "detail": "no such account"}`))
+		default:
+			created = append(created, newAcct)
+			exists = true
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"status": "valid"}`))
+		}
+	})
+	defer srv.Close()
+
+	var asked []string
+	c := newTestClient(srv)
+	c.KID = ""
+	c.Directory.Meta.TermsOfService = "https://example.org/tos/v1"
+	c.AgreeToTerms = func(tosURL string) bool {
+		asked = append(asked, tosURL)
+		return true
+	}
+	ctx := context.Background()
+
+	if _, err := c.newAccount(ctx, nil); err != nil {
+		t.Fatalf("creating the account failed: %v", err)
+	}
+	if len(created) != 1 || !created[0].TermsOfServiceAgreed || len(asked) != 1 {
+		t.Fatalf("expected the account to be created after agreeing to the terms once, created %v, asked %v", created, asked)
+	}
+	if c.TermsOfService != "https://example.org/tos/v1" {
+		t.Errorf("expected the agreed terms to be recorded, got %q", c.TermsOfService)
+	}
+
+	c.Directory.Meta.TermsOfService = "https://example.org/tos/v2"
+	if _, err := c.newAccount(ctx, nil); err != nil {
+		t.Fatalf("looking up the existing account failed: %v", err)
+	}
+	if len(created) != 1 || len(asked) != 1 {
+		t.Errorf("an existing account must be neither created again nor asked to agree, created %v, asked %v", created, asked)
+	}
+	if c.TermsOfService != "https://example.org/tos/v1" {
+		t.Errorf("changed terms must not be recorded as agreed, got %q", c.TermsOfService)
+	}
+	if tos, changed := c.TermsOfServiceChanged(); !changed || tos != "https://example.org/tos/v2" {
+		t.Errorf("expected the changed terms to be reported, got %q, %t", tos, changed)
+	}
+}
+
+// newTestCertPEM returns a PEM encoded self-signed cert for names, valid from notBefore to notAfter.
+func newTestCertPEM(t *testing.T, names []string, notBefore, notAfter time.Time) []byte {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		DNSNames:       names,
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+		AuthorityKeyId: []byte{1, 2, 3, 4},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestRevokeCertificateLooksUpAccount(t *testing.T) {
+	exists := false
+	var requests []testRequest
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		requests = append(requests, req)
+		switch req.Path {
+		case "/new-account":
+			var newAcct NewAccount
+			_ = json.Unmarshal(req.Payload, &newAcct)
+			if !newAcct.OnlyReturnExisting {
+				t.Errorf("revoking must not create an account")
+			}
+			if !exists {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"type": "urn:ietf:params:acme:error:accountDoesNotExist", "detail": "no such account"}`))
+				return
+			}
+			w.Header().Set("Location", strings.TrimSuffix(req.Protected.URL, req.Path)+"/acct/1")
+			_, _ = w.Write([]byte(`{"status": "valid"}`))
+		case "/revoke-cert":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer srv.Close()
+
+	certPEM := newTestCertPEM(t, []string{"example.org"}, time.Now(), time.Now().Add(time.Hour))
+	c := newTestClient(srv)
+	c.KID = ""
+	ctx := context.Background()
+
+	err := c.RevokeCertificate(ctx, certPEM, ReasonSuperseded)
+	if !IsAccountDoesNotExist(err) || !strings.Contains(err.Error(), "RevokeCertificateWithKey") {
+		t.Errorf("expected an error pointing to RevokeCertificateWithKey, got %v", err)
+	}
+	if len(requests) != 1 || c.KID != "" {
+		t.Errorf("expected nothing but the account lookup, got %d requests and KID %q", len(requests), c.KID)
+	}
+
+	exists = true
+	if err := c.RevokeCertificate(ctx, certPEM, ReasonSuperseded); err != nil {
+		t.Fatalf("revoking failed: %v", err)
+	}
+	revoke := requests[len(requests)-1]
+	if revoke.Path != "/revoke-cert" || revoke.Protected.KID != srv.URL+"/acct/1" {
+		t.Errorf("expected the revocation to be signed with the looked up account, got %s %+v", revoke.Path, revoke.Protected)
+	}
+}
+
+func TestRenewalOptionsNames(t *testing.T) {
+	ariRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ariRequests++
+		start := time.Now().Add(30 * 24 * time.Hour)
+		_, _ = fmt.Fprintf(w, `{"suggestedWindow": {"start": %q, "end": %q}}`,
+			start.Format(time.RFC3339), start.Add(24*time.Hour).Format(time.RFC3339))
+	}))
+	defer srv.Close()
+
+	store := &recordingCertStore{}
+	certPEM := newTestCertPEM(t, []string{"example.org", "www.example.org"}, time.Now(), time.Now().Add(90*24*time.Hour))
+	if err := store.Store("", string(certPEM), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	c := Client{
+		CertsManager:     store,
+		RenewOnlyWhenDue: true,
+		Directory:        Directory{RenewalInfo: srv.URL + "/renewal-info"},
+		RetryPolicy:      ExponentialBackoff{MaxAttempts: 1},
+	}
+	ctx := context.Background()
+
+	opts, due, err := c.renewalOptions(ctx, []string{"example.org", "WWW.example.org"})
+	if err != nil {
+		t.Fatalf("failed getting renewal options: %v", err)
+	}
+	if due || opts.Replaces == "" || ariRequests != 1 {
+		t.Errorf("expected the same names to replace the stored cert once the CA says so, got due %t, replaces %q", due, opts.Replaces)
+	}
+
+	opts, due, err = c.renewalOptions(ctx, []string{"example.org", "api.example.org"})
+	if err != nil {
+		t.Fatalf("failed getting renewal options: %v", err)
+	}
+	if !due || opts.Replaces != "" || ariRequests != 1 {
+		t.Errorf("a stored cert for other names must neither be replaced nor hold up the order, got due %t, replaces %q", due, opts.Replaces)
+	}
+}
+
+func TestPreAuthorize(t *testing.T) {
+	var newAuthz NewAuthz
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		base := strings.TrimSuffix(req.Protected.URL, req.Path)
+		switch req.Path {
+		case "/new-authz":
+			if err := json.Unmarshal(req.Payload, &newAuthz); err != nil {
+				t.Errorf("bad newAuthz payload %s: %v", req.Payload, err)
+			}
+			w.Header().Set("Location", base+"/authz/7")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"status": "pending", "identifier": {"type": "dns", "value": "www.example.org"}}`))
+		case "/authz/7":
+			_, _ = w.Write([]byte(`{"status": "valid", "identifier": {"type": "dns", "value": "www.example.org"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer srv.Close()
+
+	c := newTestClient(srv)
+	authzURL, err := c.PreAuthorize(context.Background(), "www.example.org")
+	if err != nil {
+		t.Fatalf("pre-authorizing failed: %v", err)
+	}
+	if newAuthz.Identifier != (CertIdentifier{Type: "dns", Value: "www.example.org"}) {
+		t.Errorf("unexpected newAuthz identifier %+v", newAuthz.Identifier)
+	}
+	if authzURL != srv.URL+"/authz/7" {
+		t.Errorf("expected the authorization URL from the Location header, got %q", authzURL)
+	}
+}
+
+func TestDeactivateAuthorizations(t *testing.T) {
+	authzs := map[string]string{
+		"/authz/valid":       `{"status": "valid", "identifier": {"type": "dns", "value": "example.org"}}`,
+		"/authz/pending":     `{"status": "pending", "identifier": {"type": "dns", "value": "Example.org"}}`,
+		"/authz/expired":     `{"status": "expired", "identifier": {"type": "dns", "value": "example.org"}}`,
+		"/authz/other":       `{"status": "valid", "identifier": {"type": "dns", "value": "www.example.org"}}`,
+		"/authz/second-page": `{"status": "valid", "identifier": {"type": "dns", "value": "example.org"}, "wildcard": true}`,
+	}
+	var deactivated []string
+	srv := newTestACMEServer(t, func(w http.ResponseWriter, req testRequest) {
+		base := strings.TrimSuffix(req.Protected.URL, req.Path)
+		switch {
+		case req.Path == "/acct/1":
+			_, _ = fmt.Fprintf(w, `{"status": "valid", "orders": %q}`, base+"/acct/1/orders")
+		case req.Path == "/acct/1/orders":
+			w.Header().Add("Link", `</acct/1/orders/2>;rel="next"`)
+			_, _ = fmt.Fprintf(w, `{"orders": [%q, %q]}`, base+"/order/1", base+"/order/2")
+		case req.Path == "/acct/1/orders/2":
+			_, _ = fmt.Fprintf(w, `{"orders": [%q]}`, base+"/order/3")
+		case req.Path == "/order/1":
+			_, _ = fmt.Fprintf(w, `{"status": "valid", "authorizations": [%q, %q, %q]}`, base+"/authz/valid", base+"/authz/other", base+"/authz/expired")
+		case req.Path == "/order/2":
+			_, _ = fmt.Fprintf(w, `{"status": "pending", "authorizations": [%q, %q]}`, base+"/authz/valid", base+"/authz/pending")
+		case req.Path == "/order/3":
+			_, _ = fmt.Fprintf(w, `{"status": "valid", "authorizations": [%q]}`, base+"/authz/second-page")
+		case authzs[req.Path] != "" && req.Msg.Payload == "":
+			_, _ = w.Write([]byte(authzs[req.Path]))
+		case authzs[req.Path] != "":
+			if string(req.Payload) != `{"status":"deactivated"}` {
+				t.Errorf("unexpected authorization update %s", req.Payload)
+			}
+			deactivated = append(deactivated, req.Path)
+			_, _ = w.Write([]byte(`{"status": "deactivated"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer srv.Close()
+
+	c := newTestClient(srv)
+	urls, err := c.DeactivateAuthorizations(context.Background(), "*.example.org")
+	if err != nil {
+		t.Fatalf("deactivating authorizations failed: %v", err)
+	}
+
+	expected := []string{"/authz/valid", "/authz/pending", "/authz/second-page"}
+	if strings.Join(deactivated, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %v to be deactivated, got %v", expected, deactivated)
+	}
+	if len(urls) != len(expected) || urls[0] != srv.URL+"/authz/valid" {
+		t.Errorf("unexpected deactivated authorization URLs %v", urls)
+	}
+}
@@ -0,0 +1,204 @@
+package acmev2
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RenewalInfo is the CA's renewal information for a cert (RFC 9773).
+type RenewalInfo struct {
+	SuggestedWindow RenewalWindow `json:"suggestedWindow"`
+	// ExplanationURL, if set, points to a page explaining why the window is what it is, e.g,
+	// because the cert is about to be revoked.
+	ExplanationURL string `json:"explanationURL,omitempty"`
+	// RetryAfter is when the CA would like to be asked again.
+	RetryAfter time.Time `json:"-"`
+	// CertID is the ARI cert ID (see ARICertID) of the cert the information is for.
+	CertID string `json:"-"`
+}
+
+// RenewalWindow is the time span the CA suggests renewing a cert in.
+type RenewalWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// RenewalTime picks a time within the suggested window, so that clients renewing lots of certs
+// don't all hit the CA at the start of the window.   The time is derived from CertID and the window
+// rather than picked at random, so checking the same cert again (e.g, from an hourly cron job) comes
+// up with the same time until the CA moves the window.   If the window has already ended by now, the
+// CA wants the cert replaced right away, so now is returned.
+func (r RenewalInfo) RenewalTime(now time.Time) time.Time {
+	if !now.Before(r.SuggestedWindow.End) {
+		return now
+	}
+	span := r.SuggestedWindow.End.Sub(r.SuggestedWindow.Start)
+	if span <= 0 {
+		return r.SuggestedWindow.Start
+	}
+	seed := sha256.Sum256([]byte(r.CertID + " " + r.SuggestedWindow.Start.UTC().Format(time.RFC3339Nano) + " " + r.SuggestedWindow.End.UTC().Format(time.RFC3339Nano)))
+	offset := binary.BigEndian.Uint64(seed[:8]) % uint64(span)
+	return r.SuggestedWindow.Start.Add(time.Duration(offset))
+}
+
+// ShouldRenew tells whether the suggested window has started by now.   A window in the past means
+// the CA wants the cert replaced right away.
+func (r RenewalInfo) ShouldRenew(now time.Time) bool {
+	return !now.Before(r.SuggestedWindow.Start)
+}
+
+// ARICertID returns the identifier of cert used for renewal information and for the replaces field
+// of an order, which is its authority key identifier and serial number, both base64url encoded.
+func ARICertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errors.New("cert has no authority key identifier")
+	}
+	if cert.SerialNumber == nil {
+		return "", errors.New("cert has no serial number")
+	}
+
+	// The serial is the DER encoded INTEGER without its tag and length, so it keeps the leading
+	// zero byte that positive serials with the high bit set get.
+	der, err := asn1.Marshal(cert.SerialNumber)
+	if err != nil {
+		return "", err
+	}
+	var serial asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &serial); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." + base64.RawURLEncoding.EncodeToString(serial.Bytes), nil
+}
+
+// FetchRenewalInfo asks the CA when the (first) cert in certPEM should be renewed.
+func (c *Client) FetchRenewalInfo(ctx context.Context, certPEM []byte) (RenewalInfo, error) {
+	cert, err := parseCertPEM(certPEM)
+	if err != nil {
+		return RenewalInfo{}, err
+	}
+	return c.fetchRenewalInfo(ctx, cert)
+}
+
+func (c *Client) fetchRenewalInfo(ctx context.Context, cert *x509.Certificate) (RenewalInfo, error) {
+	var info RenewalInfo
+	if c.Directory.RenewalInfo == "" {
+		return info, errors.New("directory does not provide a renewalInfo URL")
+	}
+	certID, err := ARICertID(cert)
+	if err != nil {
+		return info, err
+	}
+
+	url := strings.TrimSuffix(c.Directory.RenewalInfo, "/") + "/" + certID
+	var header http.Header
+	err = c.withRetries(ctx, RequestFetch, url, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := c.httpClient().Do(req)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = res.Body.Close() }()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			return newProblemError(res.StatusCode, res.Header, body)
+		}
+		header = res.Header
+		return json.Unmarshal(body, &info)
+	})
+	if err != nil {
+		return info, err
+	}
+	info.RetryAfter = time.Now().Add(retryAfter(header, 6*time.Hour))
+	info.CertID = certID
+
+	return info, nil
+}
+
+// renewalOptions looks for an existing cert for names, stored under the first name, and returns the
+// order options for renewing it along with whether it's due for renewal.   Certs are always due unless
+// the client is set to RenewOnlyWhenDue, in which case the CA's renewal information decides or, for
+// CAs without it, whether the cert is in the last third of its lifetime.   A stored cert for other
+// names than the ones asked for is no cert for names at all, so a new one is due and it doesn't
+// replace the stored one.
+func (c *Client) renewalOptions(ctx context.Context, names []string) (OrderOptions, bool, error) {
+	var opts OrderOptions
+	if c.CertsManager == nil {
+		return opts, true, nil
+	}
+	domain := names[0]
+	_, certPEM, err := c.CertsManager.Retrieve(domain)
+	if err != nil {
+		return opts, false, err
+	}
+	if certPEM == "" {
+		return opts, true, nil
+	}
+	cert, err := parseCertPEM([]byte(certPEM))
+	if err != nil {
+		c.log(fmt.Sprintf("Ignoring stored cert for %s that can't be parsed: %v", domain, err))
+		return opts, true, nil
+	}
+	if certNames := certNames(cert); normalizeNames(certNames) != normalizeNames(names) {
+		c.log(fmt.Sprintf("Stored cert for %s is for %v rather than %v, ordering a new one", domain, certNames, names))
+		return opts, true, nil
+	}
+
+	now := time.Now()
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	due := !now.Before(cert.NotAfter.Add(-lifetime / 3))
+
+	if c.Directory.RenewalInfo != "" {
+		info, err := c.fetchRenewalInfo(ctx, cert)
+		if err != nil {
+			c.log(fmt.Sprintf("Failed fetching renewal info for %s: %v", domain, err))
+		} else {
+			renewAt := info.RenewalTime(now)
+			c.log(fmt.Sprintf("Suggested renewal window for %s is %s to %s, renewing at %s", domain, info.SuggestedWindow.Start, info.SuggestedWindow.End, renewAt))
+			if info.ExplanationURL != "" {
+				c.log(fmt.Sprintf("Renewal window explained at %s", info.ExplanationURL))
+			}
+			due = !now.Before(renewAt)
+			opts.Replaces, _ = ARICertID(cert)
+		}
+	}
+
+	return opts, due || !c.RenewOnlyWhenDue, nil
+}
+
+// certNames returns the DNS names and IP addresses a cert is for.
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// parseCertPEM parses the first cert in certPEM.
+func parseCertPEM(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,193 @@
+package acmev2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NewAuthz is the payload for pre-authorizing an identifier (RFC 8555, section 7.4.1).
+type NewAuthz struct {
+	Identifier CertIdentifier `json:"identifier"`
+}
+
+// AuthorizationUpdate is the payload for deactivating an authorization.
+type AuthorizationUpdate struct {
+	Status string `json:"status"`
+}
+
+// PreAuthorize obtains an authorization for identifier (a DNS name or IP address) through the
+// directory's newAuthz URL and solves its challenge right away, so that a later order for the
+// identifier finds a valid authorization and doesn't have to wait for validation.   It returns
+// the URL of the authorization.   Not every CA supports pre-authorization (Let's Encrypt doesn't),
+// and wildcard names can't be pre-authorized at all.
+func (c *Client) PreAuthorize(ctx context.Context, identifier string) (string, error) {
+	if identifier == "" {
+		return "", errors.New("no identifier passed in")
+	}
+	if strings.HasPrefix(identifier, "*.") {
+		return "", fmt.Errorf("wildcard name %s can't be pre-authorized", identifier)
+	}
+	if c.Directory.NewAuthz == "" {
+		return "", errors.New("directory does not provide a newAuthz URL")
+	}
+
+	if c.KID == "" {
+		if _, err := c.newAccount(ctx, c.ContactEmails); err != nil {
+			return "", err
+		}
+	}
+
+	res, err := c.post(ctx, NewAuthz{Identifier: newIdentifier(identifier)}, c.Directory.NewAuthz, false)
+	if err != nil {
+		return "", err
+	}
+	c.log(string(res.Body))
+	authzURL := res.Header.Get("Location")
+	if authzURL == "" {
+		return "", fmt.Errorf("newAuthz response for %s has no authorization URL", identifier)
+	}
+
+	// Pre-authorizations don't belong to any order, so there's nothing to journal.
+	c.journaled = nil
+	return authzURL, c.authorize(ctx, []string{authzURL})
+}
+
+// authorize solves the challenges of the pending authorizations at authzURLs and waits for the CA
+// to validate them.   Authorizations that are already valid are left alone.   Challenge responses
+// are removed again once the CA is done validating.
+func (c *Client) authorize(ctx context.Context, authzURLs []string) error {
+	challengeURLs := make([]string, 0, len(authzURLs))
+	pendingAuthzURLs := make([]string, 0, len(authzURLs))
+	waitForDNS := false
+	for _, authzURL := range authzURLs {
+		challengeResponse, err := c.FetchChallenges(ctx, authzURL)
+		if err != nil {
+			return err
+		}
+		c.log(challengeResponse)
+
+		needsChallenge, err := challengeResponse.needsChallenge()
+		if err != nil {
+			return err
+		}
+		if !needsChallenge {
+			c.log(fmt.Sprintf("Authorization for %s is already valid, skipping its challenge", challengeResponse.Identifier.Value))
+			continue
+		}
+		pendingAuthzURLs = append(pendingAuthzURLs, authzURL)
+
+		challenge, cleanup, err := c.solveChallenge(challengeResponse)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		if err := c.journalChallenge(authzURL, challengeResponse.Identifier, challenge); err != nil {
+			return fmt.Errorf("failed journaling challenge: %v", err)
+		}
+
+		if challenge.Type == "dns-01" {
+			waitForDNS = true
+		}
+		challengeURLs = append(challengeURLs, challenge.URL)
+	}
+
+	if waitForDNS {
+		if err := sleep(ctx, 1*time.Minute); err != nil {
+			return err
+		}
+	}
+
+	for _, challengeURL := range challengeURLs {
+		if err := c.ChallengeReady(ctx, challengeURL); err != nil {
+			c.log(fmt.Sprintf("Failed posting challenge: %v\n", err))
+			return err
+		}
+	}
+
+	for _, authzURL := range pendingAuthzURLs {
+		if err := c.waitForAuthorization(ctx, authzURL); err != nil {
+			c.log(fmt.Sprintf("Authorization failed: %v\n", err))
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeactivateAuthorization deactivates the authorization at authzURL (RFC 8555, section 7.5.2), so that
+// the account can't use it to issue certs anymore.   A new order for the identifier will need its
+// challenge solved again.
+func (c *Client) DeactivateAuthorization(ctx context.Context, authzURL string) (ChallengeResponse, error) {
+	var authz ChallengeResponse
+
+	res, err := c.post(ctx, AuthorizationUpdate{Status: StatusDeactivated}, authzURL, false)
+	if err != nil {
+		return authz, err
+	}
+	c.log(string(res.Body))
+	err = json.Unmarshal(res.Body, &authz)
+	return authz, err
+}
+
+// DeactivateAuthorizations deactivates every valid or pending authorization the account holds for
+// identifier, e.g, once a domain has been sold.   Pending ones are included since whoever controls
+// the domain next could otherwise still have them validated for us.   A wildcard name's
+// authorizations are for the name without the leading "*.", so both are matched by that name.   The
+// authorizations are found by going through the account's orders, which not every CA lists (Let's
+// Encrypt doesn't).   It returns the URLs of the authorizations that were deactivated.
+func (c *Client) DeactivateAuthorizations(ctx context.Context, identifier string) ([]string, error) {
+	if identifier == "" {
+		return nil, errors.New("no identifier passed in")
+	}
+	id := newIdentifier(strings.TrimPrefix(identifier, "*."))
+
+	orderURLs, err := c.ListOrders(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var deactivated []string
+	for _, orderURL := range orderURLs {
+		order, err := c.FetchOrder(ctx, orderURL)
+		if err != nil {
+			return deactivated, err
+		}
+		for _, authzURL := range order.Authorizations {
+			if seen[authzURL] {
+				continue
+			}
+			seen[authzURL] = true
+
+			authz, _, err := c.fetchAuthorization(ctx, authzURL)
+			if err != nil {
+				return deactivated, err
+			}
+			if (authz.Status != StatusValid && authz.Status != StatusPending) || !strings.EqualFold(authz.Identifier.Value, id.Value) || authz.Identifier.Type != id.Type {
+				continue
+			}
+			if _, err := c.DeactivateAuthorization(ctx, authzURL); err != nil {
+				return deactivated, err
+			}
+			c.log(fmt.Sprintf("Deactivated authorization %s for %s", authzURL, id.Value))
+			deactivated = append(deactivated, authzURL)
+		}
+	}
+
+	return deactivated, nil
+}
+
+// fetchAuthorization fetches the authorization at url.
+func (c *Client) fetchAuthorization(ctx context.Context, url string) (ChallengeResponse, acmeResponse, error) {
+	var authz ChallengeResponse
+	res, err := c.post(ctx, nil, url, true)
+	if err != nil {
+		return authz, res, err
+	}
+	err = json.Unmarshal(res.Body, &authz)
+	return authz, res, err
+}
@@ -3,12 +3,18 @@ package acmev2
 import (
 	"bufio"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"time"
 )
@@ -25,6 +31,27 @@ type CertIdentifier struct {
 // CertApply lets us marshal the JSON cert application
 type CertApply struct {
 	Identifiers []CertIdentifier `json:"identifiers"`
+	// Replaces is the ARI cert ID of the cert this order renews.
+	Replaces string `json:"replaces,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	// NotBefore and NotAfter are pointers so they're left out unless they're set.
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+}
+
+// OrderOptions are optional fields for a new order.
+type OrderOptions struct {
+	// Replaces is the ARI cert ID (see ARICertID) of the cert the new order renews, which lets
+	// the CA know the old cert is about to be replaced.   Only set it for CAs whose directory
+	// provides a renewalInfo URL.
+	Replaces string
+	// Profile is the name of one of the certificate profiles listed in the directory meta (e.g,
+	// "classic" or "shortlived").   The CA's default profile is used if it's empty.
+	Profile string
+	// NotBefore and NotAfter request a validity window for the cert.   Either can be left zero.
+	// Not every CA honors them, Let's Encrypt for instance rejects orders that set them.
+	NotBefore time.Time
+	NotAfter  time.Time
 }
 
 // CertResponse lets us unmarshal the response for a cert application
@@ -37,13 +64,19 @@ type CertResponse struct {
 	Authorizations []string         `json:"authorizations"`
 	Finalize       string           `json:"finalize"`
 	Certificate    string           `json:"certificate"`
+	Profile        string           `json:"profile"`
+	// Error is why the order went invalid, if it did.
+	Error *ProblemError `json:"error,omitempty"`
 }
 
 // Challenge is back because I haven't removed it from the client yet.
 type Challenge struct {
-	Type  string `json:"type"`
-	URL   string `json:"url"`
-	Token string `json:"token"`
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status,omitempty"`
+	// Error is why validating the challenge failed, if it did.
+	Error *ProblemError `json:"error,omitempty"`
 }
 
 // ChallengeResponse lets us unmarshal the response for the challenges for a domain
@@ -51,6 +84,9 @@ type ChallengeResponse struct {
 	Status     string         `json:"status"`
 	Expires    time.Time      `json:"expires"`
 	Identifier CertIdentifier `json:"identifier"`
+	// Wildcard is set for authorizations of wildcard names, whose Identifier holds the
+	// name without the leading "*.".
+	Wildcard bool `json:"wildcard"`
 
 	Challenges []Challenge `json:"challenges"`
 	//Challenges []struct {
@@ -60,41 +96,135 @@ type ChallengeResponse struct {
 	//} `json:"challenges"`
 }
 
+// findChallenge returns the challenge of the given type (e.g, "dns-01"), if the server offered one.
+func (cr ChallengeResponse) findChallenge(challengeType string) (Challenge, bool) {
+	for _, ch := range cr.Challenges {
+		if ch.Type == challengeType {
+			return ch, true
+		}
+	}
+	return Challenge{}, false
+}
+
+// needsChallenge tells whether a challenge has to be solved for the authorization.   That's only the
+// case for pending authorizations, valid ones are re-used as they are and any other status means the
+// authorization can't be used for the order anymore.
+func (cr ChallengeResponse) needsChallenge() (bool, error) {
+	switch cr.Status {
+	case StatusPending:
+		return true, nil
+	case StatusValid:
+		return false, nil
+	}
+	return false, cr.err()
+}
+
+// err returns the error of an authorization that can't be used, which is the problem the CA ran
+// into validating its challenge if that's why it's invalid.
+func (cr ChallengeResponse) err() error {
+	for _, ch := range cr.Challenges {
+		if ch.Error != nil {
+			problem := *ch.Error
+			if problem.Identifier == nil {
+				id := cr.Identifier
+				problem.Identifier = &id
+			}
+			return &problem
+		}
+	}
+	return fmt.Errorf("authorization for %s is %q", cr.Identifier.Value, cr.Status)
+}
+
 // CSRRequest is the payload we send to a finalize
 type CSRRequest struct {
 	CSR string `json:"csr"`
 }
 
-// CertApply takes a slice of domain names and tries to appy for certs for them.
+// CertApply takes a slice of domain names (or IP addresses) and tries to appy for certs for them.
 func (c *Client) CertApply(ctx context.Context, domains []string) (CertResponse, error) {
+	return c.CertApplyWithOptions(ctx, domains, OrderOptions{})
+}
+
+// CertApplyWithOptions works like CertApply, but sends the optional fields in opts along with the order.
+func (c *Client) CertApplyWithOptions(ctx context.Context, domains []string, opts OrderOptions) (CertResponse, error) {
 	identifiers := make([]CertIdentifier, 0, len(domains))
 	for _, domain := range domains {
-		identifiers = append(identifiers, CertIdentifier{"dns", domain})
+		identifiers = append(identifiers, newIdentifier(domain))
+	}
+
+	if opts.Profile != "" {
+		if _, ok := c.Directory.Meta.Profiles[opts.Profile]; !ok {
+			return CertResponse{}, fmt.Errorf("CA does not offer a certificate profile named %q", opts.Profile)
+		}
+	}
+
+	if !opts.NotBefore.IsZero() && !opts.NotAfter.IsZero() && !opts.NotAfter.After(opts.NotBefore) {
+		return CertResponse{}, fmt.Errorf("requested notAfter %s is not after notBefore %s", opts.NotAfter, opts.NotBefore)
 	}
 
 	application := CertApply{
 		Identifiers: identifiers,
+		Replaces:    opts.Replaces,
+		Profile:     opts.Profile,
+	}
+	if !opts.NotBefore.IsZero() {
+		notBefore := opts.NotBefore.UTC()
+		application.NotBefore = &notBefore
+	}
+	if !opts.NotAfter.IsZero() {
+		notAfter := opts.NotAfter.UTC()
+		application.NotAfter = &notAfter
 	}
 
-	res, err := c.makeRequest(ctx, application, c.Directory.NewOrder, false)
-
-	fmt.Println(string(res))
 	var certRes CertResponse
-	err = json.Unmarshal(res, &certRes)
+	res, err := c.post(ctx, application, c.Directory.NewOrder, false)
+	var problem *ProblemError
+	if application.Replaces != "" && errors.As(err, &problem) && problem.HasType(ProblemAlreadyReplaced) {
+		// An earlier run may have finalized the replacement and then failed to store it, which
+		// leaves a cert that still needs renewing but can't be named as replaced anymore.
+		c.log(fmt.Sprintf("Cert %s was already replaced, ordering again without replaces", application.Replaces))
+		application.Replaces = ""
+		res, err = c.post(ctx, application, c.Directory.NewOrder, false)
+	}
+	// CAs that don't accept the requested window say so with a malformed problem, every other problem
+	// has nothing to do with it.
+	if errors.As(err, &problem) && problem.HasType(ProblemMalformed) && (application.NotBefore != nil || application.NotAfter != nil) {
+		return certRes, fmt.Errorf("CA rejected the order with the requested validity window (notBefore %s, notAfter %s): %w",
+			formatOptionalTime(opts.NotBefore), formatOptionalTime(opts.NotAfter), err)
+	}
+	if err != nil {
+		return certRes, err
+	}
+
+	c.log(string(res.Body))
+	err = json.Unmarshal(res.Body, &certRes)
 
 	if certRes.Finalize != "" {
 		c.Finalize = certRes.Finalize
 	}
+	if orderURL := res.Header.Get("Location"); orderURL != "" {
+		c.OrderURL = orderURL
+	}
 
 	return certRes, err
 }
 
+// formatOptionalTime formats t for error messages, which for a zero time is "unset".
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return "unset"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
 // FetchChallenges requests a URL from the CertApply response to find out what challenges are available to prove domain ownership.
 func (c *Client) FetchChallenges(ctx context.Context, url string) (ChallengeResponse, error) {
 	var chRes ChallengeResponse
-	c.OrderURL = url
 	res, err := c.makeRequest(ctx, nil, url, true)
-	fmt.Println(string(res))
+	if err != nil {
+		return chRes, err
+	}
+	c.log(string(res))
 	err = json.Unmarshal(res, &chRes)
 
 	return chRes, err
@@ -107,71 +237,62 @@ func (c *Client) ChallengeReady(ctx context.Context, challengeURL string) error
 	return err
 }
 
-// PollForStatus is a PostAsGet request to the order URL waiting for a non-pending status
-func (c *Client) PollForStatus(ctx context.Context, domain string) error {
-	var res []byte
-	var err error
-	challengeFinished := false
-	var certRes CertResponse
-	for !challengeFinished {
-		<-time.After(5 * time.Second)
-		res, err = c.makeRequest(ctx, EmptyRequest{}, c.OrderURL, true)
+// PollForStatus is a PostAsGet request to the order URL waiting for the order to leave the pending state.
+// Once the order is ready, it's finalized with a CSR for all of the names passed in, polled again until the
+// CA is done processing it, and the resulting cert is stored under the first name.   Polling honors the
+// server's Retry-After header and stops when ctx is done.
+func (c *Client) PollForStatus(ctx context.Context, names ...string) error {
+	if len(names) == 0 {
+		return errors.New("no domain passed in")
+	}
+	domain := names[0]
+
+	certRes, err := c.waitForOrder(ctx, c.OrderURL, StatusPending)
+	if err != nil {
+		return err
+	}
+
+	if certRes.Status == StatusReady {
+		var csrTemplate x509.CertificateRequest
+		for _, name := range names {
+			if ip := net.ParseIP(name); ip != nil {
+				csrTemplate.IPAddresses = append(csrTemplate.IPAddresses, ip)
+			} else {
+				csrTemplate.DNSNames = append(csrTemplate.DNSNames, name)
+			}
+		}
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &csrTemplate, c.CertKey)
 		if err != nil {
 			return err
 		}
-		fmt.Println("While polling, got...")
-		fmt.Println(string(res))
-		err = json.Unmarshal(res, &certRes)
+
+		certRes, err = c.finalize(ctx, csr)
 		if err != nil {
 			return err
 		}
-		if certRes.Status == "valid" || certRes.Status == "invalid" {
-			fmt.Printf("Setting challengeFinished to true because status was %q\n", certRes.Status)
-			challengeFinished = true
-		}
 	}
 
-	fmt.Println("Response after exiting loop")
-	fmt.Println(string(res))
-
-	if certRes.Status != "valid" {
-		return fmt.Errorf("Cert request status %q", certRes.Status)
-	}
-
-	csrTemplate := x509.CertificateRequest{
-		DNSNames: []string{domain},
-		// EmailAddresses: c.ContactEmails,
-	}
-	csr, err := x509.CreateCertificateRequest(rand.Reader, &csrTemplate, c.CertKey)
-	if err != nil {
-		return err
+	if certRes.Status == StatusProcessing || certRes.Status == StatusReady {
+		certRes, err = c.waitForOrder(ctx, c.OrderURL, StatusProcessing, StatusReady)
+		if err != nil {
+			return err
+		}
 	}
 
-	res, err = c.makeRequest(ctx, CSRRequest{CSR: base64.RawURLEncoding.EncodeToString(csr)}, c.Finalize, false)
-	if err != nil {
-		return err
+	if certRes.Status != StatusValid {
+		if certRes.Error != nil {
+			return certRes.Error
+		}
+		return fmt.Errorf("Cert request status %q", certRes.Status)
 	}
-	fmt.Println("After sending CSR request to finalize")
-	fmt.Println(string(res))
-	err = json.Unmarshal(res, &certRes)
-	if err != nil {
-		return err
+	if certRes.Certificate == "" {
+		return errors.New("order is valid but has no certificate URL")
 	}
 
-	keyfile, err := os.Create("cert.key")
+	pemdata, err := marshalKeyPEM(c.CertKey)
 	if err != nil {
 		return err
 	}
-	defer keyfile.Close()
-	keywriter := bufio.NewWriter(keyfile)
-	pemdata := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(c.CertKey),
-	})
-	fmt.Println("Key PEM")
-	fmt.Println(string(pemdata))
-	_, err = keywriter.Write(pemdata)
-	keywriter.Flush()
 
 	certfile, err := os.Create("cert.crt")
 	if err != nil {
@@ -180,22 +301,67 @@ func (c *Client) PollForStatus(ctx context.Context, domain string) error {
 	defer certfile.Close()
 
 	certwriter := bufio.NewWriter(certfile)
-	cert, err := c.makeRequest(ctx, "", certRes.Certificate, true)
+	cert, err := c.downloadCert(ctx, certRes.Certificate)
 	if err != nil {
-		fmt.Printf("Failed downloading cert: %v\n", err)
+		c.log(fmt.Sprintf("Failed downloading cert: %v", err))
 		return err
 	}
 
-	fmt.Println("Cert PEM")
-	fmt.Println(string(cert))
-	if err != nil {
-		fmt.Printf("Unable to read cert body: %v\n", err)
-		return err
-	}
+	c.log("Cert PEM")
+	c.log(string(cert))
 	certwriter.Write(cert)
 	certwriter.Flush()
 
-	err = c.CertsManager.Store(string(pemdata), string(cert), domain)
+	err = c.CertsManager.Store(pemdata, string(cert), domain)
 
 	return err
 }
+
+// finalize sends csr to the order's finalize URL.   A finalize request that failed on the way might
+// still have made it to the CA, so instead of sending it again right away, the order is fetched
+// first: it's only finalized again if it's still ready, otherwise the CA is already on it.
+func (c *Client) finalize(ctx context.Context, csr []byte) (CertResponse, error) {
+	var certRes CertResponse
+	err := c.withRetries(ctx, RequestIdempotent, c.Finalize, func() error {
+		req := CSRRequest{CSR: base64.RawURLEncoding.EncodeToString(csr)}
+		res, err := c.sendSigned(ctx, c.Finalize, func(string) ([]byte, error) {
+			return c.JWSEncodeJSON(req, c.Finalize, false)
+		})
+		if err == nil {
+			c.log("After sending CSR request to finalize")
+			c.log(string(res.Body))
+			return json.Unmarshal(res.Body, &certRes)
+		}
+		if !IsTransient(err) {
+			return err
+		}
+		order, ferr := c.FetchOrder(ctx, c.OrderURL)
+		if ferr != nil || order.Status == StatusReady {
+			return err
+		}
+		c.log(fmt.Sprintf("Finalize request made it to the CA despite failing (%v), order is %s", err, order.Status))
+		certRes = order
+		return nil
+	})
+	return certRes, err
+}
+
+// marshalKeyPEM PEM encodes a certificate key so it can be stored alongside the cert.
+// Keys that can't be exported, such as ones living in an HSM, come back as an empty
+// string since there's nothing to store.
+func marshalKeyPEM(key crypto.Signer) (string, error) {
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey, ed25519.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		return "", nil
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
@@ -0,0 +1,95 @@
+package acmev2
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// PreferredChain picks which of the certificate chains offered by the CA gets stored.   CAs can
+// offer alternate chains, e.g, one up to a cross-signed root that older clients still trust.   If
+// no chain matches, the CA's default chain is used.
+type PreferredChain struct {
+	// IssuerCommonName matches a chain whose topmost cert was issued by a CA with this common name,
+	// which is the root the chain leads up to (e.g, "ISRG Root X1" or "DST Root CA X3").
+	IssuerCommonName string
+	// CertFingerprint matches a chain containing a cert with this hex encoded SHA-256 fingerprint.
+	// Chains don't usually include the root itself, so a root's fingerprint won't match anything:
+	// use the fingerprint of an intermediate, e.g, the cross-signed one, or IssuerCommonName for
+	// the root.   Colons between the bytes are fine.
+	CertFingerprint string
+}
+
+// IsZero tells whether no preference is set.
+func (p PreferredChain) IsZero() bool {
+	return p.IssuerCommonName == "" && p.CertFingerprint == ""
+}
+
+// matches tells whether the PEM encoded chain is the preferred one.
+func (p PreferredChain) matches(chainPEM []byte) bool {
+	var certs []*x509.Certificate
+	for rest := chainPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return false
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return false
+	}
+
+	if p.IssuerCommonName != "" && certs[len(certs)-1].Issuer.CommonName != p.IssuerCommonName {
+		return false
+	}
+	if p.CertFingerprint != "" {
+		want := strings.ToLower(strings.Replace(p.CertFingerprint, ":", "", -1))
+		found := false
+		for _, cert := range certs {
+			sum := sha256.Sum256(cert.Raw)
+			found = found || hex.EncodeToString(sum[:]) == want
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// downloadCert downloads the cert chain at url.   If the client has a PreferredChain and the default
+// chain doesn't match it, the alternate chains the CA links to are tried in turn.
+func (c *Client) downloadCert(ctx context.Context, url string) ([]byte, error) {
+	res, err := c.post(ctx, nil, url, true)
+	if err != nil {
+		return nil, err
+	}
+	if c.PreferredChain.IsZero() || c.PreferredChain.matches(res.Body) {
+		return res.Body, nil
+	}
+
+	for _, alternate := range linkURLs(res.Header, url, "alternate") {
+		alt, err := c.post(ctx, nil, alternate, true)
+		if err != nil {
+			return nil, err
+		}
+		if c.PreferredChain.matches(alt.Body) {
+			c.log(fmt.Sprintf("Using alternate chain %s", alternate))
+			return alt.Body, nil
+		}
+	}
+
+	c.warn(fmt.Sprintf("No chain matches the preferred chain %+v, using the default chain", c.PreferredChain))
+	return res.Body, nil
+}
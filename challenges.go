@@ -0,0 +1,271 @@
+package acmev2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPResponder is an interface that allows for serving http-01 challenge responses, which the CA
+// fetches from http://<identifier>/.well-known/acme-challenge/<token>.
+type HTTPResponder interface {
+	AddChallengeResponse(token, keyAuth string) error
+	RemoveChallengeResponse(token string) error
+}
+
+// TLSALPNResponder is an interface that allows for serving tls-alpn-01 challenge certs, which the CA
+// asks for with a TLS handshake to port 443 of the identifier using the "acme-tls/1" protocol.
+type TLSALPNResponder interface {
+	AddChallengeCert(identifier string, cert tls.Certificate) error
+	RemoveChallengeCert(identifier string) error
+}
+
+// idPeACMEIdentifier is the OID of the acmeIdentifier extension from RFC 8737.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// newIdentifier returns the ACME identifier for a name, which is an "ip" identifier
+// (RFC 8738) for IP addresses and a "dns" identifier for everything else.
+func newIdentifier(name string) CertIdentifier {
+	if ip := net.ParseIP(name); ip != nil {
+		return CertIdentifier{"ip", ip.String()}
+	}
+	return CertIdentifier{"dns", name}
+}
+
+// solveChallenge picks a challenge of authz we're able to solve and sets up the response for it.
+// It returns the challenge to post to once the response is in place and a function removing the
+// response again.   DNS challenges are preferred for DNS names, since they're the only ones that
+// work for wildcards, while IP addresses can only use http-01 or tls-alpn-01.
+func (c *Client) solveChallenge(authz ChallengeResponse) (Challenge, func(), error) {
+	id := authz.Identifier
+
+	if id.Type == "dns" && c.DNS != nil {
+		if ch, ok := authz.findChallenge("dns-01"); ok {
+			authHash, err := c.AcmeAuthHash(ch.Token)
+			if err != nil {
+				return ch, nil, err
+			}
+			if err := c.journalTXTRecord(id.Value, authHash); err != nil {
+				return ch, nil, err
+			}
+			if err := c.DNS.AddTextRecord(id.Value, authHash); err != nil {
+				return ch, nil, err
+			}
+			return ch, func() {
+				if err := c.DNS.RemoveTextRecord(id.Value, authHash); err != nil {
+					c.log(fmt.Sprintf("Failed removing TXT record for %s: %v", id.Value, err))
+					return
+				}
+				c.unjournalTXTRecord(id.Value, authHash)
+			}, nil
+		}
+	}
+
+	if authz.Wildcard {
+		return Challenge{}, nil, fmt.Errorf("wildcard authorization for %s needs a dns-01 challenge and a DNSModifier", id.Value)
+	}
+
+	if c.HTTP != nil {
+		if ch, ok := authz.findChallenge("http-01"); ok {
+			keyAuth, err := c.acmeAuthString(ch.Token)
+			if err != nil {
+				return ch, nil, err
+			}
+			if err := c.HTTP.AddChallengeResponse(ch.Token, keyAuth); err != nil {
+				return ch, nil, err
+			}
+			return ch, func() {
+				if err := c.HTTP.RemoveChallengeResponse(ch.Token); err != nil {
+					c.log(fmt.Sprintf("Failed removing http-01 response for %s: %v", id.Value, err))
+				}
+			}, nil
+		}
+	}
+
+	if c.TLSALPN != nil {
+		if ch, ok := authz.findChallenge("tls-alpn-01"); ok {
+			keyAuth, err := c.acmeAuthString(ch.Token)
+			if err != nil {
+				return ch, nil, err
+			}
+			cert, err := tlsALPN01Cert(id, keyAuth)
+			if err != nil {
+				return ch, nil, err
+			}
+			if err := c.TLSALPN.AddChallengeCert(id.Value, cert); err != nil {
+				return ch, nil, err
+			}
+			return ch, func() {
+				if err := c.TLSALPN.RemoveChallengeCert(id.Value); err != nil {
+					c.log(fmt.Sprintf("Failed removing tls-alpn-01 cert for %s: %v", id.Value, err))
+				}
+			}, nil
+		}
+	}
+
+	return Challenge{}, nil, fmt.Errorf("no challenge offered for %s %s that this client is set up to solve", id.Type, id.Value)
+}
+
+// tlsALPN01Cert creates the self-signed cert answering a tls-alpn-01 challenge (RFC 8737, section 3).
+func tlsALPN01Cert(id CertIdentifier, keyAuth string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	sum := sha256.Sum256([]byte(keyAuth))
+	extValue, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ACME challenge"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: idPeACMEIdentifier, Critical: true, Value: extValue},
+		},
+	}
+	if id.Type == "ip" {
+		template.IPAddresses = []net.IP{net.ParseIP(id.Value)}
+	} else {
+		template.DNSNames = []string{id.Value}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// tlsALPNServerName returns the SNI the CA sends when validating identifier, which for IP
+// addresses is the reverse DNS name of the address (RFC 8738, section 6).
+func tlsALPNServerName(identifier string) string {
+	ip := net.ParseIP(identifier)
+	if ip == nil {
+		return strings.ToLower(identifier)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	const hexDigits = "0123456789abcdef"
+	labels := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		labels = append(labels, string(hexDigits[ip[i]&0xf]), string(hexDigits[ip[i]>>4]))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
+
+// HTTPChallengeServer implements HTTPResponder as an http.Handler serving the challenge responses
+// under /.well-known/acme-challenge/.   It needs to be reachable on port 80 of every identifier.
+type HTTPChallengeServer struct {
+	mu        sync.RWMutex
+	responses map[string]string
+}
+
+// NewHTTPChallengeServer returns a pointer to an empty HTTPChallengeServer.
+func NewHTTPChallengeServer() *HTTPChallengeServer {
+	return &HTTPChallengeServer{responses: make(map[string]string)}
+}
+
+// AddChallengeResponse starts serving keyAuth for token.
+func (s *HTTPChallengeServer) AddChallengeResponse(token, keyAuth string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[token] = keyAuth
+	return nil
+}
+
+// RemoveChallengeResponse stops serving the response for token.
+func (s *HTTPChallengeServer) RemoveChallengeResponse(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.responses, token)
+	return nil
+}
+
+// ServeHTTP responds with the key authorization for known tokens and a 404 for anything else.
+func (s *HTTPChallengeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/.well-known/acme-challenge/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.RLock()
+	keyAuth, ok := s.responses[strings.TrimPrefix(r.URL.Path, prefix)]
+	s.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write([]byte(keyAuth))
+}
+
+// TLSALPNChallengeServer implements TLSALPNResponder.   Use its TLSConfig (or hook GetCertificate
+// into an existing config) for a listener on port 443 of every identifier.
+type TLSALPNChallengeServer struct {
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+// NewTLSALPNChallengeServer returns a pointer to an empty TLSALPNChallengeServer.
+func NewTLSALPNChallengeServer() *TLSALPNChallengeServer {
+	return &TLSALPNChallengeServer{certs: make(map[string]*tls.Certificate)}
+}
+
+// AddChallengeCert starts serving cert for identifier.
+func (s *TLSALPNChallengeServer) AddChallengeCert(identifier string, cert tls.Certificate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs[tlsALPNServerName(identifier)] = &cert
+	return nil
+}
+
+// RemoveChallengeCert stops serving the cert for identifier.
+func (s *TLSALPNChallengeServer) RemoveChallengeCert(identifier string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.certs, tlsALPNServerName(identifier))
+	return nil
+}
+
+// GetCertificate returns the challenge cert for the server name of an "acme-tls/1" handshake.
+func (s *TLSALPNChallengeServer) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cert, ok := s.certs[strings.ToLower(hello.ServerName)]
+	if !ok {
+		return nil, errors.New("no challenge cert for " + hello.ServerName)
+	}
+	return cert, nil
+}
+
+// TLSConfig returns a tls.Config that only speaks "acme-tls/1" and serves the challenge certs.
+func (s *TLSALPNChallengeServer) TLSConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos:     []string{"acme-tls/1"},
+		GetCertificate: s.GetCertificate,
+	}
+}
@@ -7,37 +7,85 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
-
-	jose "gopkg.in/square/go-jose.v2"
 )
 
 // ClientOpts are options for the ACME v2 client.
 type ClientOpts struct {
 	// HTTPClient lets you set an optional *http.Client if you, for instance, want to set your own timeouts or other options.
+	// All requests to the CA go through it, http.DefaultClient is used if it's nil.
 	HTTPClient *http.Client
-	// AccountKey is the ECDSA key associated with your Let's Encrypt account. You must supply either this
+	// AccountKey is the key associated with your Let's Encrypt account. You must supply either this
 	// to identify yourself for a previously created account or pass in ContactEmails to create a new
-	// account.
-	AccountKey *ecdsa.PrivateKey
+	// account.   It can be any crypto.Signer with an RSA (2048 to 4096 bits), ECDSA (P-256, P-384 or
+	// P-521) or Ed25519 public key, so keys held in an HSM or KMS work as well.
+	AccountKey crypto.Signer
 	// CertKey will be deprecated. It's a key for an existing cert to be used for renewal. It will be
-	// the CertRetriever's job to provide that.
-	CertKey *rsa.PrivateKey // TODO: Remove this eventually
+	// the CertRetriever's job to provide that.   It can be any crypto.Signer, including one backed by
+	// an HSM through PKCS#11, in which case the key is never exported and the CertStorer gets an
+	// empty key PEM.
+	CertKey crypto.Signer // TODO: Remove this eventually
 	// ContactEmails is a slice of email addresses used to identify points of contact for a Let's Encrypt
 	// account.
 	ContactEmails []string
 	// Logger takes something that implements the Logger interface.   If set, it will log any output to the
 	// Logger's Log(string) function.   Otherwise, it won't output much of anything.
 	Logger Logger
+	// HTTPResponder, if set, is used to solve http-01 challenges.   Together with TLSALPNResponder this is
+	// what allows getting certs for IP addresses, which can't be validated through DNS.
+	HTTPResponder HTTPResponder
+	// TLSALPNResponder, if set, is used to solve tls-alpn-01 challenges.
+	TLSALPNResponder TLSALPNResponder
+	// AccountStore, if set, is used to load the account key, KID and contacts when no AccountKey is
+	// passed in, and to save them whenever the account is created or changed.   An AccountKey that
+	// can't be exported (e.g, one in an HSM) isn't stored, but the KID and contacts are, and they're
+	// loaded again for the same AccountKey, which then has to be passed in every time.
+	AccountStore AccountStore
+	// AgreeToTerms is called with the URL of the CA's terms of service when creating an account, but
+	// not for accounts that exist already.   Returning true agrees to those terms.   If it's nil and the CA has terms of service, account
+	// creation fails rather than agreeing to terms nobody looked at.
+	AgreeToTerms func(tosURL string) bool
+	// EABKeyID is the key identifier for External Account Binding, as handed out by CAs that require
+	// accounts to be bound to an account in their own system (e.g, ZeroSSL or Google Trust Services).
+	EABKeyID string
+	// EABHMACKey is the base64url encoded HMAC key that goes with EABKeyID.
+	EABHMACKey string
+	// OrderJournal, if set, is used to record orders while they're in flight, so that an order
+	// interrupted by a crash is resumed (or its TXT records cleaned up) the next time a cert for
+	// the same names is requested.
+	OrderJournal OrderJournal
+	// PreferredChain, if set, picks which of the certificate chains offered by the CA gets stored.
+	PreferredChain PreferredChain
+	// RenewOnlyWhenDue makes FetchOrRenewCert(s) leave an existing cert alone until it's due for renewal,
+	// which is when the CA's suggested renewal window (ACME Renewal Information) starts or, for CAs that
+	// don't provide renewal information, once the cert is in the last third of its lifetime.
+	RenewOnlyWhenDue bool
+	// Profile is the name of the certificate profile to order certs with, which has to be one of the
+	// profiles the CA lists in its directory meta.   It can be changed between orders through the
+	// Client's Profile field.   The CA's default profile is used if it's empty.
+	Profile string
+	// CertLifetime, if set, asks the CA for certs that expire this long after being ordered, e.g, for
+	// short-lived certs that shouldn't outlive a CI job.   Only some CAs (e.g, step-ca) honor this,
+	// others reject the order.
+	CertLifetime time.Duration
+	// IssuanceLedger, if set, keeps track of the certs issued so that the client refuses orders that
+	// would go over RateLimits instead of running into the CA's rate limits.
+	IssuanceLedger IssuanceLedger
+	// RateLimits are the limits enforced with the IssuanceLedger.   Let's Encrypt's limits are used
+	// if they're left zero.
+	RateLimits RateLimits
+	// RetryPolicy decides which failed requests are sent again and when, e.g, after a connection was
+	// reset or the CA answered with a 503.   DefaultRetryPolicy is used if it's nil, an
+	// ExponentialBackoff with MaxAttempts set to 1 turns retrying off.
+	RetryPolicy RetryPolicy
 }
 
 // Logger is an interface that allows you to capture log output and do with it what you will.
@@ -45,13 +93,26 @@ type Logger interface {
 	Log(msg interface{})
 }
 
+// WarnLogger is a Logger that logs warnings separately, which are about something the client was
+// asked to do but couldn't, e.g, finding the preferred chain.   Warnings for Loggers that don't
+// implement it go to Log, prefixed with "Warning: ".
+type WarnLogger interface {
+	Logger
+	Warn(msg interface{})
+}
+
 // DNSModifier is an interface that allows for adding and removing TXT recordsets from DNS.
+// A name can carry several challenge values at once (e.g, when ordering *.example.org and
+// example.org together), so AddTextRecord has to keep any values already present and
+// RemoveTextRecord has to remove only the given value.
 type DNSModifier interface {
 	AddTextRecord(domain, token string) error
 	RemoveTextRecord(domain, token string) error
 }
 
-// CertStorer is an interface that provides a way to store a TLS key and cert for a domain.
+// CertStorer is an interface that provides a way to store a TLS key and cert for a domain.   keyPEM is
+// empty for cert keys that can't be exported (e.g, ones in an HSM), in which case only the cert should
+// be stored and any key stored before left alone.
 type CertStorer interface {
 	Store(keyPEM, certPEM, domain string) error
 }
@@ -69,175 +130,342 @@ type CertStoreRetriever interface {
 }
 
 // Client acts as an ACME client for LetsEncrypt.   It keeps track
-// of the current Nonce, the ecdsa key for signing messages, and
+// of the Nonce of the current request (backed by a pool of nonces
+// for the requests to come), the key for signing messages, and
 // the keyID.
 type Client struct {
 	Nonce         string
 	KID           string
-	Key           *ecdsa.PrivateKey
+	HTTPClient    *http.Client
+	Key           crypto.Signer
 	Directory     Directory
 	DNS           DNSModifier
+	HTTP          HTTPResponder
+	TLSALPN       TLSALPNResponder
 	CertsManager  CertStoreRetriever
 	OrderURL      string
 	ContactEmails []string
 	Finalize      string
-	CertKey       *rsa.PrivateKey
+	CertKey       crypto.Signer
 	Logger        Logger
+	EABKeyID      string
+	EABHMACKey    []byte
+	AgreeToTerms  func(tosURL string) bool
+	// TermsOfService is the URL of the terms of service that were agreed to when creating the
+	// account, if any.
+	TermsOfService   string
+	DirectoryURL     string
+	AccountStore     AccountStore
+	OrderJournal     OrderJournal
+	PreferredChain   PreferredChain
+	RenewOnlyWhenDue bool
+	Profile          string
+	CertLifetime     time.Duration
+	IssuanceLedger   IssuanceLedger
+	RateLimits       RateLimits
+	RetryPolicy      RetryPolicy
+
+	// nonces holds the nonces handed out by the server for the requests to come.
+	nonces *noncePool
+	// journaled is the journal entry of the order currently in flight, if there's an OrderJournal.
+	journaled *JournaledOrder
+}
+
+// NewClient works like NewClientWithContext, without a context to cancel fetching the directory.
+func NewClient(dirURL string, csr CertStoreRetriever, dm DNSModifier, opts ClientOpts) (Client, error) {
+	return NewClientWithContext(context.Background(), dirURL, csr, dm, opts)
 }
 
-// NewClient takes a directory URL (e.g, https://acme-staging-v02.api.letsencrypt.org/directory) and
+// NewClientWithContext takes a directory URL (e.g, https://acme-staging-v02.api.letsencrypt.org/directory) and
 // a slice of contact emails for the cert being requested (Let's Encrypt will generally send you an
 // email when a cert is approaching expiration, though I've found that to be flaky).   There's
 // the Directory from that URL and get a Nonce for the next request.
-// If no key is provided in the options, a key will be generated for a new account and be subsequently
-// available in the Key field of the Client struct.   That key can be re-used to keep using the same
-// Let's Encrypt account in the future.
-func NewClient(dirURL string, csr CertStoreRetriever, dm DNSModifier, opts ClientOpts) (Client, error) {
+// If no key is provided in the options, the account is loaded from the AccountStore if there is one,
+// or else a key will be generated for a new account and be subsequently available in the Key field of
+// the Client struct.   That key can be re-used to keep using the same Let's Encrypt account in the
+// future, which the AccountStore takes care of automatically.
+func NewClientWithContext(ctx context.Context, dirURL string, csr CertStoreRetriever, dm DNSModifier, opts ClientOpts) (Client, error) {
 	contacts := prependContacts(opts.ContactEmails)
-	c := Client{Key: opts.AccountKey, CertKey: opts.CertKey, ContactEmails: contacts}
+	c := Client{Key: opts.AccountKey, CertKey: opts.CertKey, ContactEmails: contacts, nonces: &noncePool{}}
+
+	c.HTTPClient = opts.HTTPClient
+	if c.HTTPClient == nil {
+		c.HTTPClient = http.DefaultClient
+	}
 
-	directory, err := queryDirectory(dirURL)
+	c.Logger = opts.Logger
+	c.RetryPolicy = opts.RetryPolicy
+
+	err := c.withRetries(ctx, RequestFetch, dirURL, func() (err error) {
+		c.Directory, err = queryDirectory(ctx, c.HTTPClient, dirURL)
+		return err
+	})
 	if err != nil {
 		return c, err
 	}
-	c.Directory = directory
 
-	if opts.AccountKey == nil {
+	c.DirectoryURL = dirURL
+	c.AccountStore = opts.AccountStore
+	c.OrderJournal = opts.OrderJournal
+	c.PreferredChain = opts.PreferredChain
+	c.RenewOnlyWhenDue = opts.RenewOnlyWhenDue
+	c.Profile = opts.Profile
+	c.CertLifetime = opts.CertLifetime
+	c.IssuanceLedger = opts.IssuanceLedger
+	c.RateLimits = opts.RateLimits
+
+	if c.AccountStore != nil {
+		stored, err := c.AccountStore.LoadAccount(dirURL)
+		if err != nil {
+			return c, fmt.Errorf("failed loading stored account: %v", err)
+		}
+		if stored != nil && stored.Deactivated {
+			c.log(fmt.Sprintf("Stored account %s is deactivated, not using it", stored.KID))
+			stored = nil
+		}
+		if stored != nil && c.Key == nil {
+			if stored.Key == nil {
+				return c, errors.New("stored account's key isn't exportable, pass it as AccountKey")
+			}
+			c.Key = stored.Key
+		}
+		if stored != nil && c.Key != nil && stored.matchesKey(c.Key) {
+			c.KID = stored.KID
+			c.TermsOfService = stored.TermsOfService
+			if len(c.ContactEmails) == 0 {
+				c.ContactEmails = stored.Contacts
+			}
+		}
+	}
+
+	if c.Key == nil {
 		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 		if err != nil {
-			log.Fatal(err)
+			return c, err
 		}
-		opts.AccountKey = key
+		c.Key = key
+	}
+	if err := validateAccountKey(c.Key); err != nil {
+		return c, err
 	}
 
-	if opts.Logger != nil {
-		c.Logger = opts.Logger
+	if opts.EABKeyID != "" {
+		hmacKey, err := decodeEABKey(opts.EABHMACKey)
+		if err != nil {
+			return c, fmt.Errorf("invalid EAB HMAC key: %v", err)
+		}
+		c.EABKeyID = opts.EABKeyID
+		c.EABHMACKey = hmacKey
 	}
 
+	c.AgreeToTerms = opts.AgreeToTerms
+
 	c.DNS = dm
+	c.HTTP = opts.HTTPResponder
+	c.TLSALPN = opts.TLSALPNResponder
 
 	c.CertsManager = csr
 
 	return c, nil
 }
 
+// Meta returns the meta object of the CA's directory, describing its terms of service,
+// CAA identities, certificate profiles and whether it requires external account binding.
+func (c *Client) Meta() DirectoryMeta {
+	return c.Directory.Meta
+}
+
 // FetchOrRenewCert takes a domain name and tries to renew an existing cert or, if it can't find that, get
 // a new cert.   It uses the CertStoreRetriever passed in to the client to try to fetch an existing cert and, if
 // it finds that, will re-use the existing RSA key for the cert when asking for a renewal.   Otherwise, it will
-// generate a new key and ask for a new cert.   It is not recommended to run this in parallel with other requests
+// generate a new key and ask for a new cert.   For CAs that provide renewal information, the renewal order
+// tells the CA which cert it replaces.   It is not recommended to run this in parallel with other requests
 // due to the way nonces with with the session.
 func (c *Client) FetchOrRenewCert(ctx context.Context, domain string) error {
 	if domain == "" {
 		return errors.New("no domain passed in")
 	}
+	return c.FetchOrRenewCerts(ctx, []string{domain})
+}
 
-	nonce, err := GetNonce(c.Directory.NewNonce)
-	if err != nil {
-		c.log(err)
-		return err
+// FetchOrRenewCerts works like FetchOrRenewCert, but gets a single cert covering all of the names passed in
+// as subject alternative names.   Names can be DNS names or IP addresses.   Every pending authorization in the order
+// gets its challenge solved before the order is finalized, while authorizations the account already holds (e.g, from
+// the last renewal) are valid to begin with and get re-used as they are.   The cert is stored under the first name.
+func (c *Client) FetchOrRenewCerts(ctx context.Context, names []string) error {
+	if len(names) == 0 {
+		return errors.New("no domain passed in")
+	}
+	for _, name := range names {
+		if name == "" {
+			return errors.New("empty domain passed in")
+		}
 	}
-	c.Nonce = nonce
 
-	err = c.newAccount(ctx, c.ContactEmails)
+	_, err := c.newAccount(ctx, c.ContactEmails)
 	if err != nil {
 		c.log("failed starting new session")
 		return err
 	}
 
-	certApply, err := c.CertApply(ctx, []string{domain})
+	c.journaled = nil
+	certApply, resumed, err := c.resumeOrder(ctx, names)
 	if err != nil {
 		return err
 	}
-
-	challengeResponse, err := c.FetchChallenges(ctx, certApply.Authorizations[0])
-	c.log(challengeResponse)
-	var challenge Challenge
-	for _, c := range challengeResponse.Challenges {
-		if c.Type == "dns-01" {
-			challenge = c
-			break
+	if !resumed {
+		orderOpts, due, err := c.renewalOptions(ctx, names)
+		if err != nil {
+			return err
+		}
+		if !due {
+			c.log(fmt.Sprintf("Cert for %s isn't due for renewal yet", names[0]))
+			return nil
+		}
+		if err := c.checkRateLimits(names); err != nil {
+			return err
+		}
+		orderOpts.Profile = c.Profile
+		if c.CertLifetime > 0 {
+			orderOpts.NotAfter = time.Now().Add(c.CertLifetime)
+		}
+		certApply, err = c.CertApplyWithOptions(ctx, names, orderOpts)
+		if err != nil {
+			if reset, ok := RateLimitReset(err); ok {
+				c.log(fmt.Sprintf("Rate limited by the CA until %s", reset))
+			}
+			return err
+		}
+		if err := c.journalOrder(names, certApply); err != nil {
+			return fmt.Errorf("failed journaling order: %v", err)
 		}
 	}
-	authHash, err := c.AcmeAuthHash(challenge.Token)
-	if err != nil {
-		log.Fatal(err)
+	if len(certApply.Authorizations) == 0 {
+		return fmt.Errorf("order for %v came back without authorizations", names)
+	}
+
+	if err := c.authorize(ctx, certApply.Authorizations); err != nil {
 		return err
 	}
-	c.log(authHash)
 
-	err = c.DNS.AddTextRecord(domain, authHash)
+	err = c.PollForStatus(ctx, names...)
 	if err != nil {
-		log.Fatal(err)
+		c.log(fmt.Sprintf("Bad response when polling: %v\n", err))
 		return err
 	}
+	if err := c.recordIssuance(names); err != nil {
+		c.log(fmt.Sprintf("Failed recording issuance: %v", err))
+	}
 
-	defer func() {
-		err = c.DNS.RemoveTextRecord(domain, authHash)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
+	return c.finishOrder(names)
+}
 
-	<-time.After(1 * time.Minute)
+// acmeResponse holds the parts of an ACME server response that callers sometimes need
+// beyond the body, such as the status code or the Location header.   Responses with a
+// status code outside of 2xx come back from post as a *ProblemError.
+type acmeResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
 
-	err = c.ChallengeReady(ctx, challenge.URL)
-	if err != nil {
-		c.log(fmt.Sprintf("Failed posting challenge: %v\n", err))
-		return err
+// linkURLs returns the targets of the Link headers with relation rel (e.g, "next" or "alternate"),
+// resolved against the URL the response came from.
+func linkURLs(h http.Header, base, rel string) []string {
+	var urls []string
+	for _, header := range h[http.CanonicalHeaderKey("Link")] {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			target = strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "rel") {
+					continue
+				}
+				matches := false
+				for _, r := range strings.Fields(strings.Trim(kv[1], `"`)) {
+					matches = matches || strings.EqualFold(r, rel)
+				}
+				if !matches {
+					continue
+				}
+				if b, err := url.Parse(base); err == nil {
+					if u, err := b.Parse(target); err == nil {
+						target = u.String()
+					}
+				}
+				urls = append(urls, target)
+			}
+		}
 	}
+	return urls
+}
 
-	err = c.PollForStatus(ctx, domain)
-	if err != nil {
-		c.log(fmt.Sprintf("Bad response when polling: %v\n", err))
-		return err
-	}
+func (c *Client) makeRequest(ctx context.Context, claimset interface{}, url string, postAsGet bool) ([]byte, error) {
+	res, err := c.post(ctx, claimset, url, postAsGet)
+	return res.Body, err
+}
 
-	return nil
+func (c *Client) post(ctx context.Context, claimset interface{}, url string, postAsGet bool) (acmeResponse, error) {
+	return c.postSigned(ctx, c.requestKind(url, postAsGet), url, func(string) ([]byte, error) {
+		return c.JWSEncodeJSON(claimset, url, postAsGet)
+	})
 }
 
-func (c *Client) makeRequest(ctx context.Context, claimset interface{}, url string, postAsGet bool) ([]byte, error) {
-	var b []byte
-	token, err := c.JWSEncodeJSON(claimset, url, postAsGet)
-	if err != nil {
-		return b, err
-	}
+// postJWS sends an already signed request to url.
+func (c *Client) postJWS(ctx context.Context, token []byte, url string) (acmeResponse, error) {
+	var r acmeResponse
 
 	c.log(fmt.Sprintf("Request token sent to %s\n", url))
 	c.log(string(token))
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(token))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(token))
 	if err != nil {
 		c.log("Failed on http.NewRequest")
-		return b, err
+		return r, err
 	}
 
 	req.Header.Set("Content-Type", "application/jose+json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.httpClient().Do(req)
 	if err != nil {
-		c.log("Failed on executing http.DefaultClient.Do")
-		return b, err
+		c.log("Failed on executing request")
+		return r, err
 	}
 	defer func() { _ = res.Body.Close() }()
 
-	b, err = ioutil.ReadAll(res.Body)
+	r.StatusCode = res.StatusCode
+	r.Header = res.Header
+	r.Body, err = ioutil.ReadAll(res.Body)
 	if err != nil {
 		c.log("Failed reading response body")
-		return b, err
+		return r, err
 	}
 
-	c.Nonce = res.Header.Get("Replay-Nonce")
+	c.noncePool().put(res.Header.Get("Replay-Nonce"))
+	if res.StatusCode >= 300 {
+		return r, newProblemError(res.StatusCode, res.Header, r.Body)
+	}
 	if c.KID == "" {
 		c.KID = res.Header.Get("Location")
 	}
 
-	return b, nil
+	return r, nil
 }
 
-func queryDirectory(url string) (Directory, error) {
+func queryDirectory(ctx context.Context, hc *http.Client, url string) (Directory, error) {
 	var d Directory
 
-	res, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return d, err
+	}
+	res, err := hc.Do(req)
 	if err != nil {
 		return d, err
 	}
@@ -247,17 +475,31 @@ func queryDirectory(url string) (Directory, error) {
 	if err != nil {
 		return d, err
 	}
+	if res.StatusCode >= 300 {
+		return d, newProblemError(res.StatusCode, res.Header, dirJSON)
+	}
 
 	d, err = Parse(dirJSON)
 	return d, err
 }
 
-// JWKThumbprint gets a thumbprint of the JWK as defined by RFC7638
-func JWKThumbprint(key *ecdsa.PrivateKey, hash crypto.Hash) ([]byte, error) {
-	jwk := jose.JSONWebKey{Key: key}
-	return jwk.Thumbprint(hash)
-
-	// return acme.JWKThumbprint(key.Public())
+// JWKThumbprint gets a thumbprint of the JWK as defined by RFC7638.   It takes either a public key
+// or a crypto.Signer, in which case the signer's public key is used.
+func JWKThumbprint(key crypto.PublicKey, hash crypto.Hash) ([]byte, error) {
+	if signer, ok := key.(crypto.Signer); ok {
+		key = signer.Public()
+	}
+	// jwkEncode already produces the required members in lexicographic order.
+	jwk, err := jwkEncode(key)
+	if err != nil {
+		return nil, err
+	}
+	if !hash.Available() {
+		return nil, errors.New("Unsupported hash")
+	}
+	h := hash.New()
+	h.Write([]byte(jwk))
+	return h.Sum(nil), nil
 }
 
 func (c *Client) acmeAuthString(token string) (string, error) {
@@ -283,12 +525,28 @@ func (c *Client) AcmeAuthHash(token string) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
 }
 
+// httpClient returns the *http.Client to send requests with.
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
 func (c *Client) log(msg interface{}) {
 	if c.Logger != nil {
 		c.Logger.Log(fmt.Sprintf("%s\n", msg))
 	}
 }
 
+func (c *Client) warn(msg interface{}) {
+	if wl, ok := c.Logger.(WarnLogger); ok {
+		wl.Warn(fmt.Sprintf("%s\n", msg))
+	} else if c.Logger != nil {
+		c.Logger.Log(fmt.Sprintf("Warning: %s\n", msg))
+	}
+}
+
 func prependContacts(c []string) []string {
 	contacts := make([]string, len(c))
 	for i := range c {
@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/swerveaux/acmev2"
@@ -25,10 +31,44 @@ func main() {
 	// key, err := rsa.GenerateKey(rand.Reader, 2048)
 	var contactsArg string
 	var domainsArg string
+	var eabKeyID string
+	var eabHMACKey string
+	var agreeTOS bool
+	var accountDir string
+	var orderDir string
+	var singleCert bool
+	var httpListen string
+	var revokeCert string
+	var revokeKey string
+	var revokeReason int
+	var preferredChain string
+	var renewWhenDue bool
+	var profile string
+	var certLifetime time.Duration
+	var ledgerDir string
+	var maxAttempts int
+	var directoryURL string
 	ctx := context.Background()
 
 	pflag.StringVar(&contactsArg, "contacts", "somebody@example.org", "Command separated list of email contacts")
 	pflag.StringVar(&domainsArg, "domains", "example.org", "Comma separated list of domains to request certs for.")
+	pflag.StringVar(&eabKeyID, "eab-kid", "", "External Account Binding key ID, for CAs that require it.")
+	pflag.StringVar(&eabHMACKey, "eab-hmac-key", "", "External Account Binding HMAC key (base64url encoded).")
+	pflag.BoolVar(&agreeTOS, "agree-tos", false, "Agree to the CA's terms of service.")
+	pflag.StringVar(&accountDir, "account-dir", "", "Directory to keep the ACME account in between runs.")
+	pflag.StringVar(&orderDir, "order-dir", "", "Directory to journal in-flight orders in, so they can be resumed after a crash.")
+	pflag.BoolVar(&singleCert, "single-cert", false, "Request one cert covering all domains instead of one cert per domain.")
+	pflag.StringVar(&httpListen, "http-listen", "", "Address to serve http-01 challenges on (e.g, :80), needed for IP address certs.")
+	pflag.StringVar(&revokeCert, "revoke", "", "Revoke the PEM encoded cert in this file instead of fetching certs.")
+	pflag.StringVar(&revokeKey, "revoke-key", "", "Sign the revocation with the cert's PEM encoded private key in this file instead of the account key.")
+	pflag.IntVar(&revokeReason, "revoke-reason", 0, "RFC 5280 revocation reason code (e.g, 1 for keyCompromise, 4 for superseded).")
+	pflag.StringVar(&preferredChain, "preferred-chain", "", "Common name of the root to prefer a chain up to (e.g, \"ISRG Root X1\"), if the CA offers alternate chains.")
+	pflag.BoolVar(&renewWhenDue, "renew-when-due", false, "Only renew existing certs once they're due, as suggested by the CA's renewal information if it has any.")
+	pflag.StringVar(&profile, "profile", "", "Certificate profile to order certs with (e.g, classic or shortlived), if the CA offers profiles.")
+	pflag.DurationVar(&certLifetime, "cert-lifetime", 0, "Ask the CA for certs that expire this long after being ordered (e.g, 2h), for CAs that honor it.")
+	pflag.StringVar(&ledgerDir, "ledger-dir", "", "Directory to keep a ledger of issued certs in, to stay within Let's Encrypt's rate limits.")
+	pflag.IntVar(&maxAttempts, "max-attempts", 4, "How often to send a request that failed with a network or server error at most (1 turns off retrying).")
+	pflag.StringVar(&directoryURL, "directory", acmeStagingURL, fmt.Sprintf("ACME directory URL (e.g, %s for production or %s for a local Pebble).", acmeURL, acmeLocalURL))
 	pflag.Parse()
 
 	contacts := strings.Split(contactsArg, ",")
@@ -46,14 +86,50 @@ func main() {
 	}
 
 	acmeClientOpts := acmev2.ClientOpts{
-		CertKey:       certKey,
-		ContactEmails: contacts,
-		Logger:        acmev2.StdoutLogger{},
+		CertKey:          certKey,
+		ContactEmails:    contacts,
+		Logger:           acmev2.StdoutLogger{},
+		EABKeyID:         eabKeyID,
+		EABHMACKey:       eabHMACKey,
+		PreferredChain:   acmev2.PreferredChain{IssuerCommonName: preferredChain},
+		RenewOnlyWhenDue: renewWhenDue,
+		Profile:          profile,
+		CertLifetime:     certLifetime,
+		AgreeToTerms: func(tosURL string) bool {
+			fmt.Printf("Terms of service: %s (agreed: %t)\n", tosURL, agreeTOS)
+			return agreeTOS
+		},
 	}
 
-	acmeURL := acmeStagingURL
-	if acmeURL == acmeLocalURL {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	retryPolicy := acmev2.DefaultRetryPolicy
+	retryPolicy.MaxAttempts = maxAttempts
+	acmeClientOpts.RetryPolicy = retryPolicy
+
+	if accountDir != "" {
+		acmeClientOpts.AccountStore = acmev2.NewFileAccountStore(accountDir)
+	}
+
+	if ledgerDir != "" {
+		acmeClientOpts.IssuanceLedger = acmev2.NewFileIssuanceLedger(ledgerDir)
+	}
+
+	if orderDir != "" {
+		acmeClientOpts.OrderJournal = acmev2.NewFileOrderJournal(orderDir)
+	}
+
+	if httpListen != "" {
+		challengeServer := acmev2.NewHTTPChallengeServer()
+		acmeClientOpts.HTTPResponder = challengeServer
+		go func() {
+			log.Fatal(http.ListenAndServe(httpListen, challengeServer))
+		}()
+	}
+
+	if directoryURL == acmeLocalURL {
+		// Pebble uses a cert from its own test CA.
+		acmeClientOpts.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		}
 	}
 
 	certStore, err := acmev2.NewASMCertStore("us-east-1")
@@ -66,14 +142,79 @@ func main() {
 		log.Fatal(err)
 	}
 
-	client, err := acmev2.NewClient(acmeURL, certStore, dnsModifier, acmeClientOpts)
+	client, err := acmev2.NewClientWithContext(ctx, directoryURL, certStore, dnsModifier, acmeClientOpts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if revokeCert != "" {
+		if err := revoke(ctx, &client, revokeCert, revokeKey, acmev2.RevocationReason(revokeReason)); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Revoked %s\n", revokeCert)
+		return
+	}
+
+	if singleCert {
+		if err := client.FetchOrRenewCerts(ctx, domains); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "failed to fetch or renew cert for %s: %v\n", strings.Join(domains, ", "), err)
+		}
+		return
+	}
+
 	for _, domain := range domains {
 		if err := client.FetchOrRenewCert(ctx, domain); err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "failed to fetch or renew cert for %s\n", domain)
+			_, _ = fmt.Fprintf(os.Stderr, "failed to fetch or renew cert for %s: %v\n", domain, err)
+			if acmev2.IsRateLimited(err) {
+				if reset, ok := acmev2.RateLimitReset(err); ok {
+					_, _ = fmt.Fprintf(os.Stderr, "rate limited until %s\n", reset.Format(time.RFC1123))
+				}
+			}
 		}
 	}
 }
+
+// revoke revokes the cert in certFile, signed with the private key in keyFile if one is given and
+// with the account key otherwise.
+func revoke(ctx context.Context, client *acmev2.Client, certFile, keyFile string, reason acmev2.RevocationReason) error {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	if keyFile == "" {
+		return client.RevokeCertificate(ctx, certPEM, reason)
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return err
+	}
+	return client.RevokeCertificateWithKey(ctx, certPEM, key, reason)
+}
+
+// parsePrivateKey parses a PEM encoded PKCS#1, SEC 1 or PKCS#8 private key.
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
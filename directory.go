@@ -4,11 +4,26 @@ import "encoding/json"
 
 // Directory encodes a Acme V2 directory as a struct
 type Directory struct {
-	KeyChange  string `json:"keyChange"`
-	NewAccount string `json:"newAccount"`
-	NewNonce   string `json:"newNonce"`
-	NewOrder   string `json:"newOrder"`
-	RevokeCert string `json:"revokeCert"`
+	KeyChange   string        `json:"keyChange"`
+	NewAccount  string        `json:"newAccount"`
+	NewNonce    string        `json:"newNonce"`
+	NewOrder    string        `json:"newOrder"`
+	RevokeCert  string        `json:"revokeCert"`
+	NewAuthz    string        `json:"newAuthz"`
+	RenewalInfo string        `json:"renewalInfo"`
+	Meta        DirectoryMeta `json:"meta"`
+}
+
+// DirectoryMeta is the optional meta object of a directory, describing the CA's terms
+// and capabilities.
+type DirectoryMeta struct {
+	TermsOfService          string   `json:"termsOfService"`
+	Website                 string   `json:"website"`
+	CAAIdentities           []string `json:"caaIdentities"`
+	ExternalAccountRequired bool     `json:"externalAccountRequired"`
+	// Profiles maps the names of the certificate profiles the CA offers to a human
+	// readable description (or URL) of each.
+	Profiles map[string]string `json:"profiles"`
 }
 
 // Parse gets a chunk of JSON and unmarshals it into a Directory, or else returns an error
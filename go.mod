@@ -4,6 +4,6 @@ go 1.13
 
 require (
 	github.com/aws/aws-sdk-go v1.29.32
+	github.com/miekg/pkcs11 v1.1.1
 	github.com/spf13/pflag v1.0.5
-	gopkg.in/square/go-jose.v2 v2.4.1
 )
@@ -0,0 +1,86 @@
+package acmev2
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// KeyChange is the payload of the inner JWS for an account key rollover.
+type KeyChange struct {
+	Account string          `json:"account"`
+	OldKey  json.RawMessage `json:"oldKey"`
+}
+
+// KeyNotPersistedError is returned by RolloverAccountKey when the CA rolled the account over to
+// the new key, but saving that key to the client's AccountStore failed.   The rollover itself
+// went through and the client uses the new key from then on.
+type KeyNotPersistedError struct {
+	Err error
+}
+
+func (e *KeyNotPersistedError) Error() string {
+	return fmt.Sprintf("account key rolled over, but persisting the new key failed: %v", e.Err)
+}
+
+func (e *KeyNotPersistedError) Unwrap() error {
+	return e.Err
+}
+
+// RolloverAccountKey replaces the key of the current account with newKey as described in
+// RFC 8555, section 7.3.5.   If newKey is nil, a new P-256 key is generated.   The account
+// has to exist already (Client.KID must be set).   On success, Client.Key is swapped to the
+// new key, which is also returned so that it can be persisted for future runs (the client's
+// AccountStore, if any, is updated automatically).   The account and all of its authorizations
+// stay intact.
+//
+// Callers must keep the returned key even when err is non-nil.   Once the keyChange request has
+// been sent, the new key is returned on every error: if the request timed out, the CA may have
+// switched the account to the new key anyway, and a *KeyNotPersistedError means it did, but the
+// AccountStore couldn't save it.
+func (c *Client) RolloverAccountKey(ctx context.Context, newKey crypto.Signer) (crypto.Signer, error) {
+	if c.Directory.KeyChange == "" {
+		return nil, errors.New("directory does not provide a keyChange URL")
+	}
+	if c.KID == "" {
+		return nil, errors.New("no account KID set, the account has to be created before rolling over its key")
+	}
+
+	if newKey == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		newKey = key
+	}
+	if err := validateAccountKey(newKey); err != nil {
+		return nil, err
+	}
+
+	oldJWK, err := jwkEncode(c.Key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	inner, err := jwsEncodeJSONWithJWK(newKey, KeyChange{Account: c.KID, OldKey: json.RawMessage(oldJWK)}, c.Directory.KeyChange)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.post(ctx, json.RawMessage(inner), c.Directory.KeyChange, false); err != nil {
+		return newKey, err
+	}
+
+	c.log("Account key rolled over")
+	c.Key = newKey
+
+	if err := c.saveAccount(); err != nil {
+		return newKey, &KeyNotPersistedError{Err: err}
+	}
+	return newKey, nil
+}
@@ -2,28 +2,101 @@ package acmev2
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 )
 
 // NewAccount encapsulates what we need to create a new account
 type NewAccount struct {
-	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
-	Contact              []string `json:"contact"`
+	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed,omitempty"`
+	Contact              []string `json:"contact,omitempty"`
+	OnlyReturnExisting   bool     `json:"onlyReturnExisting,omitempty"`
+	// ExternalAccountBinding is the HS256 signed JWS binding this account to an account
+	// at the CA, for CAs that require it.
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding,omitempty"`
 }
 
 // newAccount is the first thing to hit after creating a client.
 // If your public key matches a previous attempt, the server should
 // respond back with that account, otherwise it'll create a new one
-// for you.
-func (c *Client) newAccount(ctx context.Context, contactEmails []string) error {
+// for you.   The terms of service are only agreed to (and recorded)
+// when the account is actually created, an existing account whose
+// terms changed since is reported through the log and
+// TermsOfServiceChanged instead.
+func (c *Client) newAccount(ctx context.Context, contactEmails []string) (Account, error) {
+	acct, err := c.LookupAccount(ctx)
+	if err == nil {
+		if tos, changed := c.TermsOfServiceChanged(); changed {
+			c.log(fmt.Sprintf("Terms of service changed from %s to %s since the account was created, they haven't been agreed to", c.TermsOfService, tos))
+		}
+		return acct, c.saveAccount()
+	}
+	if !IsAccountDoesNotExist(err) {
+		return acct, err
+	}
+
 	newAcct := NewAccount{
-		Contact:              contactEmails,
-		TermsOfServiceAgreed: true,
+		Contact: contactEmails,
+	}
+
+	tos := c.Directory.Meta.TermsOfService
+	if tos != "" {
+		if c.AgreeToTerms == nil || !c.AgreeToTerms(tos) {
+			return Account{}, fmt.Errorf("terms of service at %s have not been agreed to", tos)
+		}
+		newAcct.TermsOfServiceAgreed = true
 	}
 
-	res, err := c.makeRequest(ctx, newAcct, c.Directory.NewAccount, false)
+	if c.EABKeyID != "" {
+		eab, err := jwsEncodeEAB(c.Key.Public(), c.EABKeyID, c.EABHMACKey, c.Directory.NewAccount)
+		if err != nil {
+			return Account{}, err
+		}
+		newAcct.ExternalAccountBinding = eab
+	} else if c.Directory.Meta.ExternalAccountRequired {
+		return Account{}, errors.New("CA requires external account binding, but no EAB key ID and HMAC key were provided")
+	}
+
+	res, err := c.post(ctx, newAcct, c.Directory.NewAccount, false)
+	if err != nil {
+		return acct, err
+	}
+	c.log(string(res.Body))
+	if err := json.Unmarshal(res.Body, &acct); err != nil {
+		return acct, err
+	}
+	acct.URL = c.KID
+	if res.StatusCode == http.StatusCreated && newAcct.TermsOfServiceAgreed {
+		c.TermsOfService = tos
+		acct.TermsOfService = tos
+	}
+
+	return acct, c.saveAccount()
+}
+
+// TermsOfServiceChanged tells whether the CA's current terms of service differ from the ones
+// agreed to when the account was created, returning the current ones.   It can't tell for
+// accounts that weren't created by this client (or loaded from its AccountStore).
+func (c *Client) TermsOfServiceChanged() (string, bool) {
+	tos := c.Directory.Meta.TermsOfService
+	return tos, tos != "" && c.TermsOfService != "" && tos != c.TermsOfService
+}
+
+// postAccount sends an account request to url and unmarshals the account object the
+// server responds with.
+func (c *Client) postAccount(ctx context.Context, claimset interface{}, url string) (Account, error) {
+	var acct Account
+
+	res, err := c.post(ctx, claimset, url, claimset == nil)
+	if err != nil {
+		return acct, err
+	}
+	c.log(string(res.Body))
 
-	fmt.Println(string(res))
+	err = json.Unmarshal(res.Body, &acct)
+	acct.URL = c.KID
 
-	return err
+	return acct, err
 }
@@ -1,16 +1,133 @@
 package acmev2
 
-import "net/http"
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// maxPooledNonces is how many nonces the client holds on to.   Servers expire nonces after a while,
+// so there's no point in keeping lots of them around.
+const maxPooledNonces = 10
 
 // GetNonce takes a URL to fetch a new nonce from the acme server and returns it or an error
 func GetNonce(url string) (string, error) {
+	return getNonce(context.Background(), http.DefaultClient, url)
+}
+
+func getNonce(ctx context.Context, hc *http.Client, url string) (string, error) {
 	var nonce string
 
-	res, err := http.Head(url)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return nonce, err
+	}
+	res, err := hc.Do(req)
 	if err != nil {
 		return nonce, err
 	}
 	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return nonce, newProblemError(res.StatusCode, res.Header, nil)
+	}
 	nonce = res.Header.Get("Replay-Nonce")
 	return nonce, nil
 }
+
+// noncePool keeps the nonces handed out in Replay-Nonce headers until they're used.   The most
+// recent nonce is used first, since it's the least likely to have expired.
+type noncePool struct {
+	mu     sync.Mutex
+	nonces []string
+}
+
+// put adds nonce to the pool, dropping the oldest nonce if the pool is full.
+func (p *noncePool) put(nonce string) {
+	if nonce == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.nonces) == maxPooledNonces {
+		p.nonces = append(p.nonces[:0], p.nonces[1:]...)
+	}
+	p.nonces = append(p.nonces, nonce)
+}
+
+// get takes the most recent nonce out of the pool, if there is one.
+func (p *noncePool) get() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.nonces) == 0 {
+		return "", false
+	}
+	nonce := p.nonces[len(p.nonces)-1]
+	p.nonces = p.nonces[:len(p.nonces)-1]
+	return nonce, true
+}
+
+// nextNonce returns a nonce for the next request, taken from the pool or, if that's empty,
+// freshly fetched from the directory's newNonce URL.
+func (c *Client) nextNonce(ctx context.Context) (string, error) {
+	if nonce, ok := c.noncePool().get(); ok {
+		return nonce, nil
+	}
+	var nonce string
+	err := c.withRetries(ctx, RequestFetch, c.Directory.NewNonce, func() (err error) {
+		nonce, err = getNonce(ctx, c.httpClient(), c.Directory.NewNonce)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if nonce == "" {
+		return "", fmt.Errorf("no nonce returned by %s", c.Directory.NewNonce)
+	}
+	return nonce, nil
+}
+
+// noncePool returns the client's nonce pool, creating it for clients that weren't created by NewClient.
+func (c *Client) noncePool() *noncePool {
+	if c.nonces == nil {
+		c.nonces = &noncePool{}
+	}
+	return c.nonces
+}
+
+// postSigned sends a request signed by sign to url like sendSigned, retrying failures as the client's
+// RetryPolicy allows for a request of the given kind, each time with a new nonce.
+func (c *Client) postSigned(ctx context.Context, kind RequestKind, url string, sign func(nonce string) ([]byte, error)) (acmeResponse, error) {
+	var res acmeResponse
+	err := c.withRetries(ctx, kind, url, func() (err error) {
+		res, err = c.sendSigned(ctx, url, sign)
+		return err
+	})
+	return res, err
+}
+
+// sendSigned signs a request with a fresh nonce using sign and sends it to url.   If the server
+// rejects the nonce, which load balancers in front of the CA make happen every now and then, the
+// request is signed again with another nonce and retried once.
+func (c *Client) sendSigned(ctx context.Context, url string, sign func(nonce string) ([]byte, error)) (acmeResponse, error) {
+	var res acmeResponse
+	for attempt := 1; ; attempt++ {
+		nonce, err := c.nextNonce(ctx)
+		if err != nil {
+			return res, err
+		}
+		c.Nonce = nonce
+
+		token, err := sign(nonce)
+		if err != nil {
+			return res, err
+		}
+
+		res, err = c.postJWS(ctx, token, url)
+		if err != nil && IsBadNonce(err) && attempt < 2 {
+			c.log(fmt.Sprintf("Nonce rejected by %s, retrying with a new one", url))
+			continue
+		}
+		return res, err
+	}
+}
@@ -0,0 +1,128 @@
+package acmev2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultPollInterval is how long to wait between polls when the server doesn't send a Retry-After header.
+const defaultPollInterval = 5 * time.Second
+
+// Order statuses, see RFC 8555, section 7.1.6.   An order starts out pending until all of its
+// authorizations are valid, is ready to be finalized, processing while the CA issues the cert and
+// valid once the cert can be downloaded.   It can turn invalid at any point.
+const (
+	StatusPending    = "pending"
+	StatusReady      = "ready"
+	StatusProcessing = "processing"
+	StatusValid      = "valid"
+	StatusInvalid    = "invalid"
+)
+
+// Authorization statuses besides the ones shared with orders, see RFC 8555, section 7.1.6.   Only
+// pending authorizations need a challenge solved, valid ones can be re-used until they expire.
+const (
+	StatusDeactivated = "deactivated"
+	StatusExpired     = "expired"
+	StatusRevoked     = "revoked"
+)
+
+// retryAfter returns how long the Retry-After header asks us to wait, which can either be a
+// number of seconds or an HTTP date.   It falls back to fallback if the header isn't set or
+// can't be parsed.
+func retryAfter(h http.Header, fallback time.Duration) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return fallback
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return fallback
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// FetchOrder fetches the current state of the order at url.
+func (c *Client) FetchOrder(ctx context.Context, url string) (CertResponse, error) {
+	order, _, err := c.fetchOrder(ctx, url)
+	return order, err
+}
+
+func (c *Client) fetchOrder(ctx context.Context, url string) (CertResponse, acmeResponse, error) {
+	var order CertResponse
+	res, err := c.post(ctx, nil, url, true)
+	if err != nil {
+		return order, res, err
+	}
+	c.log(string(res.Body))
+	err = json.Unmarshal(res.Body, &order)
+	return order, res, err
+}
+
+// waitForOrder polls the order at url for as long as its status is one of waitWhile, honoring
+// the server's Retry-After header between polls, and returns the order once it moved on.
+func (c *Client) waitForOrder(ctx context.Context, url string, waitWhile ...string) (CertResponse, error) {
+	for {
+		order, res, err := c.fetchOrder(ctx, url)
+		if err != nil {
+			return order, err
+		}
+		if !containsStatus(waitWhile, order.Status) {
+			return order, nil
+		}
+		c.log(fmt.Sprintf("Order is %s, polling again", order.Status))
+		if err := sleep(ctx, retryAfter(res.Header, defaultPollInterval)); err != nil {
+			return order, err
+		}
+	}
+}
+
+// waitForAuthorization polls an authorization URL until the server is done validating it.
+func (c *Client) waitForAuthorization(ctx context.Context, url string) error {
+	for {
+		authz, res, err := c.fetchAuthorization(ctx, url)
+		if err != nil {
+			return err
+		}
+		switch authz.Status {
+		case StatusValid:
+			return nil
+		case StatusPending:
+			if err := sleep(ctx, retryAfter(res.Header, defaultPollInterval)); err != nil {
+				return err
+			}
+		default:
+			return authz.err()
+		}
+	}
+}
+
+func containsStatus(statuses []string, status string) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
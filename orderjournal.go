@@ -0,0 +1,280 @@
+package acmev2
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// JournaledOrder is what gets recorded about an order in flight, so that a client restarted
+// after a crash can pick the order back up or clean up after it.
+type JournaledOrder struct {
+	Names          []string                 `json:"names"`
+	OrderURL       string                   `json:"orderURL"`
+	Finalize       string                   `json:"finalize"`
+	Authorizations []JournaledAuthorization `json:"authorizations"`
+	// DNSRecords are the TXT records added for dns-01 challenges that haven't been removed yet.
+	DNSRecords []JournaledTXTRecord `json:"dnsRecords,omitempty"`
+	// CertKeyThumbprint identifies the cert key the order is being finalized with.   An order that
+	// was already finalized is only resumed with the same key, since its cert is bound to it.
+	CertKeyThumbprint string `json:"certKeyThumbprint,omitempty"`
+}
+
+// JournaledAuthorization is an authorization of a journaled order and the challenge picked to solve it.
+type JournaledAuthorization struct {
+	URL           string         `json:"url"`
+	Identifier    CertIdentifier `json:"identifier"`
+	ChallengeType string         `json:"challengeType,omitempty"`
+	ChallengeURL  string         `json:"challengeURL,omitempty"`
+	Token         string         `json:"token,omitempty"`
+}
+
+// JournaledTXTRecord is a TXT record value added for the _acme-challenge record of Domain.
+type JournaledTXTRecord struct {
+	Domain string `json:"domain"`
+	Value  string `json:"value"`
+}
+
+// OrderJournal is an interface that provides a way to persist orders while they're in flight, keyed
+// by the directory URL of the CA and the names on the order.   LoadOrder should return nil, nil if no
+// order has been journaled for those names vs. an actual error trying to load it.   DeleteOrder should
+// not return an error if there's nothing to delete.
+type OrderJournal interface {
+	LoadOrder(dirURL string, names []string) (*JournaledOrder, error)
+	SaveOrder(dirURL string, order JournaledOrder) error
+	DeleteOrder(dirURL string, names []string) error
+}
+
+// FileOrderJournal implements OrderJournal by keeping one JSON file per order in Dir.
+type FileOrderJournal struct {
+	Dir string
+}
+
+// NewFileOrderJournal returns a pointer to a FileOrderJournal keeping its files in dir.
+func NewFileOrderJournal(dir string) *FileOrderJournal {
+	return &FileOrderJournal{Dir: dir}
+}
+
+// LoadOrder reads the order journaled for names at dirURL, if there is one.
+func (j *FileOrderJournal) LoadOrder(dirURL string, names []string) (*JournaledOrder, error) {
+	b, err := ioutil.ReadFile(j.path(dirURL, names))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var order JournaledOrder
+	if err := json.Unmarshal(b, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// SaveOrder writes the order, readable only by the current user.   The file is replaced atomically
+// so a crash while saving doesn't leave a truncated journal behind.
+func (j *FileOrderJournal) SaveOrder(dirURL string, order JournaledOrder) error {
+	b, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(j.Dir, 0700); err != nil {
+		return err
+	}
+	path := j.path(dirURL, order.Names)
+	if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// DeleteOrder removes the order journaled for names at dirURL.
+func (j *FileOrderJournal) DeleteOrder(dirURL string, names []string) error {
+	err := os.Remove(j.path(dirURL, names))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// path names the file after the directory and a hash of the names, since orders can carry
+// far more names than fit in a file name.
+func (j *FileOrderJournal) path(dirURL string, names []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(names, ",")))
+	return filepath.Join(j.Dir, fmt.Sprintf("order_%s_%s.json", accountName(dirURL), hex.EncodeToString(sum[:8])))
+}
+
+// resumeOrder looks for a journaled order for names and returns it if it can still be completed.
+// Orders that went invalid, or that were finalized with a different cert key, are cleaned up and
+// forgotten, in which case ok is false and a new order should be placed.
+func (c *Client) resumeOrder(ctx context.Context, names []string) (certRes CertResponse, ok bool, err error) {
+	if c.OrderJournal == nil {
+		return certRes, false, nil
+	}
+	journaled, err := c.OrderJournal.LoadOrder(c.DirectoryURL, names)
+	if err != nil {
+		return certRes, false, fmt.Errorf("failed loading journaled order: %v", err)
+	}
+	if journaled == nil {
+		return certRes, false, nil
+	}
+	c.journaled = journaled
+
+	certRes, err = c.FetchOrder(ctx, journaled.OrderURL)
+	switch {
+	case err != nil:
+		c.log(fmt.Sprintf("Failed fetching journaled order %s, starting over: %v", journaled.OrderURL, err))
+	case certRes.Status == StatusInvalid || certRes.Status == "":
+		c.log(fmt.Sprintf("Journaled order %s is %q, starting over", journaled.OrderURL, certRes.Status))
+	case (certRes.Status == StatusProcessing || certRes.Status == StatusValid) &&
+		journaled.CertKeyThumbprint != c.certKeyThumbprint():
+		c.log(fmt.Sprintf("Journaled order %s was finalized with another cert key, starting over", journaled.OrderURL))
+	default:
+		c.log(fmt.Sprintf("Resuming journaled order %s, which is %s", journaled.OrderURL, certRes.Status))
+		c.OrderURL = journaled.OrderURL
+		c.Finalize = journaled.Finalize
+		if certRes.Finalize != "" {
+			c.Finalize = certRes.Finalize
+		}
+		return certRes, true, nil
+	}
+
+	return CertResponse{}, false, c.CleanupOrder(names)
+}
+
+// journalOrder starts a journal entry for an order that was just placed.
+func (c *Client) journalOrder(names []string, certRes CertResponse) error {
+	if c.OrderJournal == nil {
+		return nil
+	}
+	journaled := &JournaledOrder{
+		Names:             names,
+		OrderURL:          c.OrderURL,
+		Finalize:          c.Finalize,
+		CertKeyThumbprint: c.certKeyThumbprint(),
+	}
+	for _, authzURL := range certRes.Authorizations {
+		journaled.Authorizations = append(journaled.Authorizations, JournaledAuthorization{URL: authzURL})
+	}
+	c.journaled = journaled
+	return c.saveJournal()
+}
+
+// journalChallenge records the challenge picked for the authorization at authzURL.
+func (c *Client) journalChallenge(authzURL string, id CertIdentifier, ch Challenge) error {
+	if c.journaled == nil {
+		return nil
+	}
+	for i := range c.journaled.Authorizations {
+		a := &c.journaled.Authorizations[i]
+		if a.URL == authzURL {
+			a.Identifier = id
+			a.ChallengeType = ch.Type
+			a.ChallengeURL = ch.URL
+			a.Token = ch.Token
+		}
+	}
+	return c.saveJournal()
+}
+
+// journalTXTRecord records a TXT record before it's added, so it can't leak if we crash right after.
+func (c *Client) journalTXTRecord(domain, value string) error {
+	if c.journaled == nil {
+		return nil
+	}
+	rec := JournaledTXTRecord{Domain: domain, Value: value}
+	for _, r := range c.journaled.DNSRecords {
+		if r == rec {
+			return nil
+		}
+	}
+	c.journaled.DNSRecords = append(c.journaled.DNSRecords, rec)
+	return c.saveJournal()
+}
+
+// unjournalTXTRecord forgets a TXT record once it has been removed again.
+func (c *Client) unjournalTXTRecord(domain, value string) {
+	if c.journaled == nil {
+		return
+	}
+	rec := JournaledTXTRecord{Domain: domain, Value: value}
+	remaining := make([]JournaledTXTRecord, 0, len(c.journaled.DNSRecords))
+	for _, r := range c.journaled.DNSRecords {
+		if r != rec {
+			remaining = append(remaining, r)
+		}
+	}
+	c.journaled.DNSRecords = remaining
+	if err := c.saveJournal(); err != nil {
+		c.log(fmt.Sprintf("Failed updating order journal: %v", err))
+	}
+}
+
+// finishOrder removes the TXT records still listed in the journal entry of an order that's done and
+// deletes the entry.   Records are left over when an order is resumed after a crash, since the
+// authorizations they were added for are valid by then and their challenges aren't solved again.
+func (c *Client) finishOrder(names []string) error {
+	journaled := c.journaled
+	c.journaled = nil
+	if c.OrderJournal == nil {
+		return nil
+	}
+
+	if journaled != nil {
+		for _, r := range journaled.DNSRecords {
+			if c.DNS == nil {
+				return fmt.Errorf("journaled order has TXT records for %s but no DNSModifier to remove them", r.Domain)
+			}
+			if err := c.DNS.RemoveTextRecord(r.Domain, r.Value); err != nil {
+				return fmt.Errorf("failed removing journaled TXT record for %s: %v", r.Domain, err)
+			}
+		}
+	}
+
+	return c.OrderJournal.DeleteOrder(c.DirectoryURL, names)
+}
+
+func (c *Client) saveJournal() error {
+	if c.OrderJournal == nil || c.journaled == nil {
+		return nil
+	}
+	return c.OrderJournal.SaveOrder(c.DirectoryURL, *c.journaled)
+}
+
+// CleanupOrder removes the TXT records left behind by a journaled order for names, e.g, after a
+// crash, and forgets about the order.   The order itself is left alone at the CA and simply expires.
+func (c *Client) CleanupOrder(names []string) error {
+	if c.OrderJournal == nil {
+		return nil
+	}
+	journaled, err := c.OrderJournal.LoadOrder(c.DirectoryURL, names)
+	if err != nil {
+		return err
+	}
+	if journaled == nil {
+		return nil
+	}
+
+	c.journaled = journaled
+	return c.finishOrder(names)
+}
+
+// certKeyThumbprint identifies the client's cert key, or returns "" if there's none.
+func (c *Client) certKeyThumbprint() string {
+	if c.CertKey == nil {
+		return ""
+	}
+	thumb, err := JWKThumbprint(c.CertKey, crypto.SHA256)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(thumb)
+}
@@ -0,0 +1,7 @@
+// Package pkcs11 provides crypto.Signers for keys living in a PKCS#11 token, such as an HSM or
+// SoftHSM, so they can be used as the ACME account key (acmev2.ClientOpts.AccountKey) and the
+// certificate key (acmev2.ClientOpts.CertKey) without the private keys ever leaving the token.
+//
+// The package needs cgo and is only built with the pkcs11 build tag (go build -tags pkcs11), so
+// that the acmev2 package itself stays free of cgo.
+package pkcs11
@@ -0,0 +1,343 @@
+//go:build pkcs11
+// +build pkcs11
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	p11 "github.com/miekg/pkcs11"
+)
+
+// Config tells Open which PKCS#11 module and token to use.
+type Config struct {
+	// Path is the PKCS#11 module to load, e.g, /usr/lib/softhsm/libsofthsm2.so.
+	Path string
+	// TokenLabel is the label of the token holding the keys.
+	TokenLabel string
+	// Pin is the user PIN of the token.
+	Pin string
+}
+
+// Session is a logged in session with a PKCS#11 token.   It's safe for concurrent use, though
+// requests to the token are made one at a time.
+type Session struct {
+	mu      sync.Mutex
+	ctx     *p11.Ctx
+	session p11.SessionHandle
+}
+
+// Signer is a crypto.Signer for an ECDSA (P-256, P-384 or P-521) or RSA private key in a PKCS#11
+// token.   It signs with CKM_ECDSA or CKM_RSA_PKCS, so RSA-PSS isn't supported.
+type Signer struct {
+	s    *Session
+	priv p11.ObjectHandle
+	pub  crypto.PublicKey
+}
+
+var errNotFound = errors.New("no such object")
+
+// curveOIDs are the named curves a token's CKA_EC_PARAMS can hold.
+var curveOIDs = map[string]asn1.ObjectIdentifier{
+	"P-256": {1, 2, 840, 10045, 3, 1, 7},
+	"P-384": {1, 3, 132, 0, 34},
+	"P-521": {1, 3, 132, 0, 35},
+}
+
+// digestInfoPrefixes are the DER encoded DigestInfo headers that CKM_RSA_PKCS expects in front of
+// a digest (RFC 8017, section 9.2).
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Open loads the PKCS#11 module at cfg.Path, opens a session with the token labeled
+// cfg.TokenLabel and logs in with cfg.Pin.   The session should be closed once the keys aren't
+// needed anymore.
+func Open(cfg Config) (*Session, error) {
+	ctx := p11.New(cfg.Path)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed loading PKCS#11 module %s", cfg.Path)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed initializing PKCS#11 module: %v", err)
+	}
+
+	s := &Session{ctx: ctx}
+	if err := s.open(cfg); err != nil {
+		_ = ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) open(cfg Config) error {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("failed listing PKCS#11 slots: %v", err)
+	}
+	for _, slot := range slots {
+		info, err := s.ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != cfg.TokenLabel {
+			continue
+		}
+
+		s.session, err = s.ctx.OpenSession(slot, p11.CKF_SERIAL_SESSION|p11.CKF_RW_SESSION)
+		if err != nil {
+			return fmt.Errorf("failed opening session with token %s: %v", cfg.TokenLabel, err)
+		}
+		if err := s.ctx.Login(s.session, p11.CKU_USER, cfg.Pin); err != nil {
+			_ = s.ctx.CloseSession(s.session)
+			return fmt.Errorf("failed logging in to token %s: %v", cfg.TokenLabel, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("no PKCS#11 token labeled %s", cfg.TokenLabel)
+}
+
+// Close logs out, closes the session and unloads the PKCS#11 module.   Signers from the session
+// can't be used anymore afterwards.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_ = s.ctx.Logout(s.session)
+	err := s.ctx.CloseSession(s.session)
+	if ferr := s.ctx.Finalize(); err == nil {
+		err = ferr
+	}
+	s.ctx.Destroy()
+	return err
+}
+
+// FindKey returns a Signer for the private key labeled label.   The token has to hold a public
+// key with the same label as well, which is where the public half is read from.
+func (s *Session) FindKey(label string) (*Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	priv, err := s.findObject([]*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_PRIVATE_KEY),
+		p11.NewAttribute(p11.CKA_LABEL, label),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed finding private key %s: %v", label, err)
+	}
+
+	for _, keyType := range []uint{p11.CKK_EC, p11.CKK_RSA} {
+		pub, err := s.findObject([]*p11.Attribute{
+			p11.NewAttribute(p11.CKA_CLASS, p11.CKO_PUBLIC_KEY),
+			p11.NewAttribute(p11.CKA_KEY_TYPE, keyType),
+			p11.NewAttribute(p11.CKA_LABEL, label),
+		})
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed finding public key %s: %v", label, err)
+		}
+		return s.signer(priv, pub, keyType)
+	}
+	return nil, fmt.Errorf("no ECDSA or RSA public key labeled %s", label)
+}
+
+// GenerateECDSAKey generates an ECDSA key pair on curve in the token, labeled label.   The private
+// key is marked sensitive and can't be extracted.
+func (s *Session) GenerateECDSAKey(label string, curve elliptic.Curve) (*Signer, error) {
+	oid, ok := curveOIDs[curve.Params().Name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve %s", curve.Params().Name)
+	}
+	params, err := asn1.Marshal(oid)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.generateKey(label, p11.CKM_EC_KEY_PAIR_GEN, p11.CKK_EC, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_EC_PARAMS, params),
+	})
+}
+
+// GenerateRSAKey generates an RSA key pair of the given size in the token, labeled label.   The
+// private key is marked sensitive and can't be extracted.
+func (s *Session) GenerateRSAKey(label string, bits int) (*Signer, error) {
+	return s.generateKey(label, p11.CKM_RSA_PKCS_KEY_PAIR_GEN, p11.CKK_RSA, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_MODULUS_BITS, bits),
+		p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+	})
+}
+
+func (s *Session) generateKey(label string, mechanism, keyType uint, pubAttrs []*p11.Attribute) (*Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pubTemplate := append([]*p11.Attribute{
+		p11.NewAttribute(p11.CKA_TOKEN, true),
+		p11.NewAttribute(p11.CKA_VERIFY, true),
+		p11.NewAttribute(p11.CKA_LABEL, label),
+	}, pubAttrs...)
+	privTemplate := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_TOKEN, true),
+		p11.NewAttribute(p11.CKA_PRIVATE, true),
+		p11.NewAttribute(p11.CKA_SIGN, true),
+		p11.NewAttribute(p11.CKA_SENSITIVE, true),
+		p11.NewAttribute(p11.CKA_EXTRACTABLE, false),
+		p11.NewAttribute(p11.CKA_LABEL, label),
+	}
+
+	pub, priv, err := s.ctx.GenerateKeyPair(s.session, []*p11.Mechanism{p11.NewMechanism(mechanism, nil)}, pubTemplate, privTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating key %s: %v", label, err)
+	}
+	return s.signer(priv, pub, keyType)
+}
+
+// findObject returns the one object matching template.
+func (s *Session) findObject(template []*p11.Attribute) (p11.ObjectHandle, error) {
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, err
+	}
+	objects, _, err := s.ctx.FindObjects(s.session, 2)
+	if ferr := s.ctx.FindObjectsFinal(s.session); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch len(objects) {
+	case 0:
+		return 0, errNotFound
+	case 1:
+		return objects[0], nil
+	}
+	return 0, errors.New("more than one object matches")
+}
+
+// signer reads the public key pub of the given type and pairs it up with the private key priv.
+func (s *Session) signer(priv, pub p11.ObjectHandle, keyType uint) (*Signer, error) {
+	var publicKey crypto.PublicKey
+	var err error
+	switch keyType {
+	case p11.CKK_EC:
+		publicKey, err = s.ecdsaPublicKey(pub)
+	case p11.CKK_RSA:
+		publicKey, err = s.rsaPublicKey(pub)
+	default:
+		err = fmt.Errorf("unsupported key type %d", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{s: s, priv: priv, pub: publicKey}, nil
+}
+
+func (s *Session) ecdsaPublicKey(pub p11.ObjectHandle) (*ecdsa.PublicKey, error) {
+	attrs, err := s.ctx.GetAttributeValue(s.session, pub, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_EC_PARAMS, nil),
+		p11.NewAttribute(p11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed reading EC public key: %v", err)
+	}
+
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(attrs[0].Value, &oid); err != nil {
+		return nil, fmt.Errorf("failed parsing EC params: %v", err)
+	}
+	var curve elliptic.Curve
+	for _, c := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		if curveOIDs[c.Params().Name].Equal(oid) {
+			curve = c
+		}
+	}
+	if curve == nil {
+		return nil, fmt.Errorf("unsupported curve %s", oid)
+	}
+
+	// The point is supposed to be wrapped in a DER OCTET STRING, but some tokens leave that out.
+	point := attrs[1].Value
+	var unwrapped []byte
+	if rest, err := asn1.Unmarshal(point, &unwrapped); err == nil && len(rest) == 0 {
+		point = unwrapped
+	}
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, errors.New("failed parsing EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func (s *Session) rsaPublicKey(pub p11.ObjectHandle) (*rsa.PublicKey, error) {
+	attrs, err := s.ctx.GetAttributeValue(s.session, pub, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_MODULUS, nil),
+		p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed reading RSA public key: %v", err)
+	}
+
+	e := new(big.Int).SetBytes(attrs[1].Value)
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("RSA public exponent too large")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(attrs[0].Value), E: int(e.Int64())}, nil
+}
+
+// Public returns the public half of the key.
+func (k *Signer) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign signs digest with the key in the token.   ECDSA signatures are returned ASN.1 encoded and
+// RSA signatures are PKCS #1 v1.5 ones, like the standard library's keys do.
+func (k *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	switch k.pub.(type) {
+	case *ecdsa.PublicKey:
+		sig, err := k.s.sign(k.priv, p11.CKM_ECDSA, digest)
+		if err != nil {
+			return nil, err
+		}
+		if len(sig) == 0 || len(sig)%2 != 0 {
+			return nil, fmt.Errorf("unexpected ECDSA signature length %d", len(sig))
+		}
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+		return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, errors.New("RSA-PSS signatures aren't supported")
+		}
+		prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+		}
+		return k.s.sign(k.priv, p11.CKM_RSA_PKCS, append(append([]byte{}, prefix...), digest...))
+	}
+	return nil, fmt.Errorf("unsupported key type %T", k.pub)
+}
+
+func (s *Session) sign(priv p11.ObjectHandle, mechanism uint, data []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ctx.SignInit(s.session, []*p11.Mechanism{p11.NewMechanism(mechanism, nil)}, priv); err != nil {
+		return nil, fmt.Errorf("failed signing: %v", err)
+	}
+	sig, err := s.ctx.Sign(s.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed signing: %v", err)
+	}
+	return sig, nil
+}
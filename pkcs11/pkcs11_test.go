@@ -0,0 +1,142 @@
+//go:build pkcs11
+// +build pkcs11
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/swerveaux/acmev2"
+)
+
+// openSoftHSM opens a session with the SoftHSM token set up as the README describes, e.g:
+//
+//	softhsm2-util --init-token --free --label acme --pin 1234 --so-pin 1234
+//
+// The module, token label and PIN can be changed with SOFTHSM2_MODULE, SOFTHSM2_TOKEN and
+// SOFTHSM2_PIN.   The test is skipped unless SOFTHSM2_CONF is set.
+func openSoftHSM(t *testing.T) *Session {
+	if os.Getenv("SOFTHSM2_CONF") == "" {
+		t.Skip("SOFTHSM2_CONF not set, skipping SoftHSM test")
+	}
+	s, err := Open(Config{
+		Path:       envOr("SOFTHSM2_MODULE", "/usr/lib/softhsm/libsofthsm2.so"),
+		TokenLabel: envOr("SOFTHSM2_TOKEN", "acme"),
+		Pin:        envOr("SOFTHSM2_PIN", "1234"),
+	})
+	if err != nil {
+		t.Fatalf("failed opening SoftHSM: %v", err)
+	}
+	return s
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// destroyKey removes every object labeled label from the token.
+func destroyKey(t *testing.T, s *Session, label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.ctx.FindObjectsInit(s.session, []*p11.Attribute{p11.NewAttribute(p11.CKA_LABEL, label)}); err != nil {
+		t.Errorf("failed finding key %s to remove: %v", label, err)
+		return
+	}
+	objects, _, err := s.ctx.FindObjects(s.session, 10)
+	_ = s.ctx.FindObjectsFinal(s.session)
+	if err != nil {
+		t.Errorf("failed finding key %s to remove: %v", label, err)
+	}
+	for _, o := range objects {
+		_ = s.ctx.DestroyObject(s.session, o)
+	}
+}
+
+func TestSoftHSMAccountKey(t *testing.T) {
+	s := openSoftHSM(t)
+	defer s.Close()
+
+	label := fmt.Sprintf("acmev2-test-account-%d", time.Now().UnixNano())
+	key, err := s.GenerateECDSAKey(label, elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroyKey(t, s, label)
+
+	found, err := s.FindKey(label)
+	if err != nil {
+		t.Fatalf("failed finding the generated key: %v", err)
+	}
+	pub, ok := found.Public().(*ecdsa.PublicKey)
+	if !ok || pub.X.Cmp(key.Public().(*ecdsa.PublicKey).X) != 0 {
+		t.Fatalf("expected FindKey to return the generated key, got %v", found.Public())
+	}
+
+	c := acmev2.Client{Key: found, KID: "https://example.org/acme/acct/1", Nonce: "nonce"}
+	token, err := c.JWSEncodeJSON(map[string]string{"status": "valid"}, "https://example.org/acme/acct/1", false)
+	if err != nil {
+		t.Fatalf("failed signing a request with the HSM key: %v", err)
+	}
+	var msg acmev2.Message
+	if err := json.Unmarshal(token, &msg); err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(msg.Signature)
+	digest := sha256.Sum256([]byte(msg.Protected + "." + msg.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Errorf("expected a valid ES256 signature, got %x", sig)
+	}
+}
+
+func TestSoftHSMCertKey(t *testing.T) {
+	s := openSoftHSM(t)
+	defer s.Close()
+
+	for _, generate := range []func(string) (*Signer, error){
+		func(label string) (*Signer, error) { return s.GenerateRSAKey(label, 2048) },
+		func(label string) (*Signer, error) { return s.GenerateECDSAKey(label, elliptic.P384()) },
+	} {
+		label := fmt.Sprintf("acmev2-test-cert-%d", time.Now().UnixNano())
+		key, err := generate(label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer destroyKey(t, s, label)
+
+		template := x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: "www.example.org"},
+			DNSNames: []string{"www.example.org"},
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, &template, crypto.Signer(key))
+		if err != nil {
+			t.Fatalf("failed creating CSR with %T key: %v", key.Public(), err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			t.Errorf("CSR signed by %T key doesn't verify: %v", key.Public(), err)
+		}
+		if len(csr.DNSNames) != 1 || csr.DNSNames[0] != "www.example.org" {
+			t.Errorf("unexpected CSR names %v", csr.DNSNames)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package acmev2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// problemTypePrefix is the namespace of the ACME error types, see RFC 8555, section 6.7.
+const problemTypePrefix = "urn:ietf:params:acme:error:"
+
+// ACME error types, without the "urn:ietf:params:acme:error:" prefix.
+const (
+	ProblemAccountDoesNotExist     = "accountDoesNotExist"
+	ProblemAlreadyReplaced         = "alreadyReplaced"
+	ProblemAlreadyRevoked          = "alreadyRevoked"
+	ProblemBadCSR                  = "badCSR"
+	ProblemBadNonce                = "badNonce"
+	ProblemBadPublicKey            = "badPublicKey"
+	ProblemBadRevocationReason     = "badRevocationReason"
+	ProblemBadSignatureAlgorithm   = "badSignatureAlgorithm"
+	ProblemCAA                     = "caa"
+	ProblemCompound                = "compound"
+	ProblemConnection              = "connection"
+	ProblemDNS                     = "dns"
+	ProblemExternalAccountRequired = "externalAccountRequired"
+	ProblemIncorrectResponse       = "incorrectResponse"
+	ProblemInvalidContact          = "invalidContact"
+	ProblemInvalidProfile          = "invalidProfile"
+	ProblemMalformed               = "malformed"
+	ProblemOrderNotReady           = "orderNotReady"
+	ProblemRateLimited             = "rateLimited"
+	ProblemRejectedIdentifier      = "rejectedIdentifier"
+	ProblemServerInternal          = "serverInternal"
+	ProblemTLS                     = "tls"
+	ProblemUnauthorized            = "unauthorized"
+	ProblemUnsupportedContact      = "unsupportedContact"
+	ProblemUnsupportedIdentifier   = "unsupportedIdentifier"
+	ProblemUserActionRequired      = "userActionRequired"
+)
+
+// ProblemError is an RFC 7807 problem document returned by the CA, either as the body of an error
+// response or as the error of a failed challenge or order.
+type ProblemError struct {
+	Type        string          `json:"type"`
+	Detail      string          `json:"detail"`
+	Status      int             `json:"status"`
+	Instance    string          `json:"instance,omitempty"`
+	Identifier  *CertIdentifier `json:"identifier,omitempty"`
+	Subproblems []Subproblem    `json:"subproblems,omitempty"`
+	// Header is the header of the response the problem came with, if any.
+	Header http.Header `json:"-"`
+}
+
+// Subproblem is a problem with one of the identifiers of a request, e.g, one of the names of an
+// order that the CA refuses to issue for.
+type Subproblem struct {
+	Type       string          `json:"type"`
+	Detail     string          `json:"detail"`
+	Identifier *CertIdentifier `json:"identifier,omitempty"`
+}
+
+func (p *ProblemError) Error() string {
+	var b strings.Builder
+	typ := strings.TrimPrefix(p.Type, problemTypePrefix)
+	if typ == "" {
+		typ = "error"
+	}
+	fmt.Fprintf(&b, "acme: %s", typ)
+	if p.Status != 0 {
+		fmt.Fprintf(&b, " (status %d)", p.Status)
+	}
+	if p.Identifier != nil {
+		fmt.Fprintf(&b, " for %s", p.Identifier.Value)
+	}
+	if p.Detail != "" {
+		fmt.Fprintf(&b, ": %s", p.Detail)
+	}
+	if reset, ok := RateLimitReset(p); ok {
+		fmt.Fprintf(&b, " (resets %s)", reset.Format(time.RFC3339))
+	}
+	for _, sub := range p.Subproblems {
+		fmt.Fprintf(&b, "; %s", strings.TrimPrefix(sub.Type, problemTypePrefix))
+		if sub.Identifier != nil {
+			fmt.Fprintf(&b, " for %s", sub.Identifier.Value)
+		}
+		if sub.Detail != "" {
+			fmt.Fprintf(&b, ": %s", sub.Detail)
+		}
+	}
+	return b.String()
+}
+
+// HasType tells whether the problem, or any of its subproblems, is of type typ (e.g, ProblemCAA).   The
+// type can be given with or without the "urn:ietf:params:acme:error:" prefix.
+func (p *ProblemError) HasType(typ string) bool {
+	typ = strings.TrimPrefix(typ, problemTypePrefix)
+	if strings.TrimPrefix(p.Type, problemTypePrefix) == typ {
+		return true
+	}
+	for _, sub := range p.Subproblems {
+		if strings.TrimPrefix(sub.Type, problemTypePrefix) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// newProblemError turns an error response into a *ProblemError.   Bodies that aren't problem documents
+// end up in Detail as they are.
+func newProblemError(statusCode int, header http.Header, body []byte) *ProblemError {
+	p := &ProblemError{}
+	if err := json.Unmarshal(body, p); err != nil || p.Type == "" {
+		p = &ProblemError{Detail: strings.TrimSpace(string(body))}
+	}
+	if p.Status == 0 {
+		p.Status = statusCode
+	}
+	p.Header = header
+	return p
+}
+
+// isProblem tells whether err is (or wraps) a *ProblemError of type typ.
+func isProblem(err error, typ string) bool {
+	var p *ProblemError
+	return errors.As(err, &p) && p.HasType(typ)
+}
+
+// IsBadNonce tells whether err is a badNonce problem, which means the request can be retried with a fresh nonce.
+func IsBadNonce(err error) bool { return isProblem(err, ProblemBadNonce) }
+
+// IsRateLimited tells whether err is a rateLimited problem, or a *RateLimitError from the client
+// refusing to go over its own RateLimits.   RateLimitReset tells when the limit resets.
+func IsRateLimited(err error) bool {
+	var rle *RateLimitError
+	return errors.As(err, &rle) || isProblem(err, ProblemRateLimited)
+}
+
+// IsUnauthorized tells whether err is an unauthorized problem, e.g, a challenge response that didn't
+// check out or an account that isn't allowed to do what it asked for.
+func IsUnauthorized(err error) bool { return isProblem(err, ProblemUnauthorized) }
+
+// IsCAA tells whether err is a caa problem, meaning a CAA record forbids the CA from issuing.
+func IsCAA(err error) bool { return isProblem(err, ProblemCAA) }
+
+// IsDNS tells whether err is a dns problem, meaning the CA failed looking up a name.
+func IsDNS(err error) bool { return isProblem(err, ProblemDNS) }
+
+// IsConnection tells whether err is a connection problem, meaning the CA couldn't reach the server
+// answering an http-01 or tls-alpn-01 challenge.
+func IsConnection(err error) bool { return isProblem(err, ProblemConnection) }
+
+// IsIncorrectResponse tells whether err is an incorrectResponse problem, meaning the challenge
+// response the CA got doesn't match what it expected.
+func IsIncorrectResponse(err error) bool { return isProblem(err, ProblemIncorrectResponse) }
+
+// IsRejectedIdentifier tells whether err is a rejectedIdentifier problem, meaning the CA won't issue
+// for one of the names.
+func IsRejectedIdentifier(err error) bool { return isProblem(err, ProblemRejectedIdentifier) }
+
+// IsMalformed tells whether err is a malformed problem.
+func IsMalformed(err error) bool { return isProblem(err, ProblemMalformed) }
+
+// IsAccountDoesNotExist tells whether err is an accountDoesNotExist problem.
+func IsAccountDoesNotExist(err error) bool { return isProblem(err, ProblemAccountDoesNotExist) }
+
+// IsServerInternal tells whether err is a serverInternal problem.
+func IsServerInternal(err error) bool { return isProblem(err, ProblemServerInternal) }
@@ -0,0 +1,264 @@
+package acmev2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimits are the issuance limits the client enforces on itself when it has an IssuanceLedger,
+// so that it stops before the CA starts refusing orders.   A zero limit isn't enforced.
+type RateLimits struct {
+	// CertsPerRegisteredDomain is how many certs can be issued for names under the same registered
+	// domain (e.g, example.org for www.example.org) within Window.   Renewals of a cert for the same
+	// set of names that's already in the ledger don't count against it.
+	CertsPerRegisteredDomain int
+	// DuplicateCerts is how many certs can be issued for the exact same set of names within Window.
+	DuplicateCerts int
+	// Window is the time span the limits apply to, which is Let's Encrypt's 7 days if it's zero.
+	Window time.Duration
+}
+
+// LetsEncryptRateLimits are Let's Encrypt's certificates per registered domain and duplicate
+// certificate limits.
+var LetsEncryptRateLimits = RateLimits{
+	CertsPerRegisteredDomain: 50,
+	DuplicateCerts:           5,
+	Window:                   7 * 24 * time.Hour,
+}
+
+// Issuance is a cert issued by the CA, as recorded in an IssuanceLedger.
+type Issuance struct {
+	Names  []string  `json:"names"`
+	Issued time.Time `json:"issued"`
+}
+
+// IssuanceLedger is an interface that provides a way to keep track of the certs issued by a CA, keyed
+// by the directory URL of the CA.   Issuances should return every issuance recorded since since.
+type IssuanceLedger interface {
+	Issuances(dirURL string, since time.Time) ([]Issuance, error)
+	RecordIssuance(dirURL string, issuance Issuance) error
+}
+
+// RateLimitError is returned when issuing a cert would exceed one of the client's RateLimits.
+type RateLimitError struct {
+	// Limit describes the limit that would be exceeded.
+	Limit string
+	// Reset is when the oldest issuance counting against the limit drops out of its window.
+	Reset time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("issuing would exceed %s, try again after %s", e.Limit, e.Reset.Format(time.RFC3339))
+}
+
+// RateLimitReset tells when a rate limit that err ran into resets, both for rateLimited problems
+// from the CA (based on their Retry-After header) and for the client's own RateLimitErrors.   The
+// bool is false if err isn't about a rate limit or the CA didn't say when it resets.
+func RateLimitReset(err error) (time.Time, bool) {
+	var rle *RateLimitError
+	if errors.As(err, &rle) {
+		return rle.Reset, true
+	}
+	var problem *ProblemError
+	if errors.As(err, &problem) && problem.HasType(ProblemRateLimited) {
+		if d := retryAfter(problem.Header, -1); d >= 0 {
+			return time.Now().Add(d), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// checkRateLimits makes sure issuing a cert for names stays within the client's RateLimits according
+// to its IssuanceLedger.
+func (c *Client) checkRateLimits(names []string) error {
+	if c.IssuanceLedger == nil {
+		return nil
+	}
+	limits := c.RateLimits
+	if limits == (RateLimits{}) {
+		limits = LetsEncryptRateLimits
+	}
+	if limits.Window <= 0 {
+		limits.Window = LetsEncryptRateLimits.Window
+	}
+
+	now := time.Now()
+	issuances, err := c.IssuanceLedger.Issuances(c.DirectoryURL, time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed reading issuance ledger: %v", err)
+	}
+
+	nameSet := normalizeNames(names)
+	renewal := false
+	var duplicates []time.Time
+	perDomain := make(map[string][]time.Time)
+	for _, issuance := range issuances {
+		same := normalizeNames(issuance.Names) == nameSet
+		renewal = renewal || same
+		if now.Sub(issuance.Issued) >= limits.Window {
+			continue
+		}
+		if same {
+			duplicates = append(duplicates, issuance.Issued)
+		}
+		for domain := range registeredDomains(issuance.Names) {
+			perDomain[domain] = append(perDomain[domain], issuance.Issued)
+		}
+	}
+
+	if limits.DuplicateCerts > 0 && len(duplicates) >= limits.DuplicateCerts {
+		return &RateLimitError{
+			Limit: fmt.Sprintf("%d duplicate certs for %s", limits.DuplicateCerts, strings.Join(names, ", ")),
+			Reset: rateLimitReset(duplicates, limits.DuplicateCerts, limits.Window),
+		}
+	}
+	if limits.CertsPerRegisteredDomain > 0 && !renewal {
+		for domain := range registeredDomains(names) {
+			if issued := perDomain[domain]; len(issued) >= limits.CertsPerRegisteredDomain {
+				return &RateLimitError{
+					Limit: fmt.Sprintf("%d certs for registered domain %s", limits.CertsPerRegisteredDomain, domain),
+					Reset: rateLimitReset(issued, limits.CertsPerRegisteredDomain, limits.Window),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// recordIssuance adds a cert just issued for names to the client's IssuanceLedger.
+func (c *Client) recordIssuance(names []string) error {
+	if c.IssuanceLedger == nil {
+		return nil
+	}
+	return c.IssuanceLedger.RecordIssuance(c.DirectoryURL, Issuance{Names: names, Issued: time.Now()})
+}
+
+// rateLimitReset returns when enough of the issuance times in issued drop out of window for
+// another issuance to fit within limit.
+func rateLimitReset(issued []time.Time, limit int, window time.Duration) time.Time {
+	sorted := append([]time.Time(nil), issued...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+	return sorted[len(sorted)-limit].Add(window)
+}
+
+// normalizeNames turns names into a key that's the same for any order or capitalization of the
+// same set of names, and for any way of writing the same IP address.
+func normalizeNames(names []string) string {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			name = ip.String()
+		}
+		set[strings.ToLower(strings.TrimSuffix(name, "."))] = true
+	}
+	unique := make([]string, 0, len(set))
+	for name := range set {
+		unique = append(unique, name)
+	}
+	sort.Strings(unique)
+	return strings.Join(unique, ",")
+}
+
+// registeredDomains returns the registered domains of names, leaving out IP addresses.   Like the
+// rest of this package, it takes the last two labels of a name to be its registered domain.
+func registeredDomains(names []string) map[string]bool {
+	domains := make(map[string]bool)
+	for _, name := range names {
+		if net.ParseIP(name) != nil {
+			continue
+		}
+		if _, domain, err := splitHostname(strings.ToLower(name)); err == nil {
+			domains[domain] = true
+		}
+	}
+	return domains
+}
+
+// maxLedgerAge is how long FileIssuanceLedger keeps issuances, which is long enough to recognize
+// renewals of 90 day certs.
+const maxLedgerAge = 120 * 24 * time.Hour
+
+// FileIssuanceLedger implements IssuanceLedger by keeping one JSON file per directory URL in Dir.
+type FileIssuanceLedger struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// NewFileIssuanceLedger returns a pointer to a FileIssuanceLedger keeping its files in dir.
+func NewFileIssuanceLedger(dir string) *FileIssuanceLedger {
+	return &FileIssuanceLedger{Dir: dir}
+}
+
+// Issuances reads the issuances recorded for dirURL since since.
+func (l *FileIssuanceLedger) Issuances(dirURL string, since time.Time) ([]Issuance, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	all, err := l.load(dirURL)
+	if err != nil {
+		return nil, err
+	}
+	var issuances []Issuance
+	for _, issuance := range all {
+		if !issuance.Issued.Before(since) {
+			issuances = append(issuances, issuance)
+		}
+	}
+	return issuances, nil
+}
+
+// RecordIssuance adds issuance to the ledger for dirURL, dropping issuances too old to matter.
+func (l *FileIssuanceLedger) RecordIssuance(dirURL string, issuance Issuance) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	all, err := l.load(dirURL)
+	if err != nil {
+		return err
+	}
+
+	issuances := []Issuance{issuance}
+	for _, i := range all {
+		if time.Since(i.Issued) < maxLedgerAge {
+			issuances = append(issuances, i)
+		}
+	}
+
+	b, err := json.Marshal(issuances)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.Dir, 0700); err != nil {
+		return err
+	}
+	path := l.path(dirURL)
+	if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (l *FileIssuanceLedger) load(dirURL string) ([]Issuance, error) {
+	b, err := ioutil.ReadFile(l.path(dirURL))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var issuances []Issuance
+	err = json.Unmarshal(b, &issuances)
+	return issuances, err
+}
+
+func (l *FileIssuanceLedger) path(dirURL string) string {
+	return filepath.Join(l.Dir, fmt.Sprintf("issuances_%s.json", accountName(dirURL)))
+}
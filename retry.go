@@ -0,0 +1,208 @@
+package acmev2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// RequestKind classifies requests to the CA by whether they're safe to send again after a failure.
+type RequestKind int
+
+const (
+	// RequestFetch is a GET, HEAD or POST-as-GET request, which can always be sent again.
+	RequestFetch RequestKind = iota
+	// RequestIdempotent is a POST that has the same effect when sent twice, like responding to a
+	// challenge, updating the account or deactivating an authorization.
+	RequestIdempotent
+	// RequestNonIdempotent is a POST that must not take effect twice, like newOrder or finalize.
+	// It's only sent again if the CA answered 503 (Service Unavailable) or the connection failed
+	// before the request was written.   A 502 or 504 from a gateway isn't enough, since the CA may
+	// well have processed the request and only the response got lost.
+	RequestNonIdempotent
+	// RequestNoRetry is a POST that is never sent again, like keyChange or revokeCert, whose replay
+	// fails when the first attempt went through (the old key is dead, the cert already revoked).
+	RequestNoRetry
+)
+
+func (k RequestKind) String() string {
+	switch k {
+	case RequestFetch:
+		return "fetch"
+	case RequestIdempotent:
+		return "idempotent"
+	case RequestNonIdempotent:
+		return "non-idempotent"
+	case RequestNoRetry:
+		return "no-retry"
+	}
+	return fmt.Sprintf("RequestKind(%d)", int(k))
+}
+
+// RetryPolicy decides whether and when to retry a failed request.   Backoff is called after the
+// request's attempt-th failure with err, elapsed being the time since it was first sent.   It returns
+// how long to wait before the next attempt or false to give up.   Each retry of a signed request gets
+// a new nonce.
+type RetryPolicy interface {
+	Backoff(kind RequestKind, attempt int, elapsed time.Duration, err error) (time.Duration, bool)
+}
+
+// ExponentialBackoff is a RetryPolicy retrying transient errors (see IsTransient) with exponentially
+// growing delays.   Requests that aren't safe to replay are only retried when the CA answered 503 or
+// the request never made it onto the wire, and RequestNoRetry requests aren't retried at all.
+type ExponentialBackoff struct {
+	// MaxAttempts is how often a request is sent at most, including the first attempt.   A value of
+	// 1 (or less) turns off retrying.
+	MaxAttempts int
+	// InitialInterval is the delay before the first retry, which doubles with every retry after
+	// that up to MaxInterval.
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// MaxElapsed is how long after the first attempt no retry is started anymore.   Zero means no limit.
+	MaxElapsed time.Duration
+	// Jitter randomizes each delay by up to this fraction of it (e.g, 0.2 for ±20%), so that clients
+	// failing at the same time don't retry in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is the RetryPolicy used when ClientOpts doesn't set one.
+var DefaultRetryPolicy = ExponentialBackoff{
+	MaxAttempts:     4,
+	InitialInterval: time.Second,
+	MaxInterval:     30 * time.Second,
+	MaxElapsed:      2 * time.Minute,
+	Jitter:          0.2,
+}
+
+// Backoff implements RetryPolicy.   A Retry-After header on the failed response is honored if it
+// asks for a longer delay.
+func (b ExponentialBackoff) Backoff(kind RequestKind, attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	if attempt >= b.MaxAttempts || !retryable(kind, err) {
+		return 0, false
+	}
+
+	delay := b.InitialInterval
+	for i := 1; i < attempt && (b.MaxInterval <= 0 || delay < b.MaxInterval); i++ {
+		delay *= 2
+	}
+	if b.MaxInterval > 0 && delay > b.MaxInterval {
+		delay = b.MaxInterval
+	}
+	if b.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * b.Jitter * float64(delay))
+	}
+
+	var problem *ProblemError
+	if errors.As(err, &problem) {
+		if d := retryAfter(problem.Header, 0); d > delay {
+			delay = d
+		}
+	}
+
+	if b.MaxElapsed > 0 && elapsed+delay > b.MaxElapsed {
+		return 0, false
+	}
+	return delay, true
+}
+
+// retryable tells whether a request of the given kind that failed with err can be sent again.
+func retryable(kind RequestKind, err error) bool {
+	switch kind {
+	case RequestNoRetry:
+		return false
+	case RequestNonIdempotent:
+		var problem *ProblemError
+		if errors.As(err, &problem) {
+			return problem.Status == http.StatusServiceUnavailable
+		}
+		return notSent(err)
+	}
+	return IsTransient(err)
+}
+
+// notSent tells whether err means the request failed before any of it was written, i.e, resolving
+// the CA's name or connecting to it failed.
+func notSent(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// IsTransient tells whether err is likely to go away by trying again, which is the case for server
+// errors and for network errors like timeouts or reset connections.   Errors about the request itself,
+// such as a bad nonce or rate limiting, and canceled contexts aren't transient.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var problem *ProblemError
+	if errors.As(err, &problem) {
+		return problem.Status >= 500 || problem.HasType(ProblemServerInternal)
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryPolicy returns the client's RetryPolicy.
+func (c *Client) retryPolicy() RetryPolicy {
+	if c.RetryPolicy == nil {
+		return DefaultRetryPolicy
+	}
+	return c.RetryPolicy
+}
+
+// withRetries calls do until it succeeds or the client's RetryPolicy gives up on the request of the
+// given kind to url, sleeping between attempts for as long as the policy says.
+func (c *Client) withRetries(ctx context.Context, kind RequestKind, url string, do func() error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := do()
+		if err == nil {
+			return nil
+		}
+		delay, ok := c.retryPolicy().Backoff(kind, attempt, time.Since(start), err)
+		if !ok {
+			if attempt > 1 {
+				c.log(fmt.Sprintf("Giving up on %s request to %s after %d attempts: %v", kind, url, attempt, err))
+			}
+			return err
+		}
+		c.log(fmt.Sprintf("Attempt %d of %s request to %s failed, retrying in %s: %v", attempt, kind, url, delay, err))
+		if serr := sleep(ctx, delay); serr != nil {
+			return err
+		}
+	}
+}
+
+// requestKind classifies a signed request to url.
+func (c *Client) requestKind(url string, postAsGet bool) RequestKind {
+	if postAsGet {
+		return RequestFetch
+	}
+	switch url {
+	case c.Directory.KeyChange, c.Directory.RevokeCert:
+		return RequestNoRetry
+	case c.Directory.NewOrder, c.Directory.NewAuthz, c.Finalize:
+		return RequestNonIdempotent
+	}
+	return RequestIdempotent
+}
@@ -0,0 +1,121 @@
+package acmev2
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// RevocationReason is a CRL reason code from RFC 5280, section 5.3.1.
+type RevocationReason int
+
+// Revocation reasons.   There's no reason code 7.   Most CAs only accept a few of these from
+// subscribers, Let's Encrypt for instance only takes Unspecified, KeyCompromise, Superseded,
+// CessationOfOperation and PrivilegeWithdrawn.
+const (
+	ReasonUnspecified          RevocationReason = 0
+	ReasonKeyCompromise        RevocationReason = 1
+	ReasonCACompromise         RevocationReason = 2
+	ReasonAffiliationChanged   RevocationReason = 3
+	ReasonSuperseded           RevocationReason = 4
+	ReasonCessationOfOperation RevocationReason = 5
+	ReasonCertificateHold      RevocationReason = 6
+	ReasonRemoveFromCRL        RevocationReason = 8
+	ReasonPrivilegeWithdrawn   RevocationReason = 9
+	ReasonAACompromise         RevocationReason = 10
+)
+
+func (r RevocationReason) valid() bool {
+	return r >= ReasonUnspecified && r <= ReasonAACompromise && r != 7
+}
+
+// RevokeRequest is the payload for revoking a cert.
+type RevokeRequest struct {
+	Certificate string           `json:"certificate"`
+	Reason      RevocationReason `json:"reason,omitempty"`
+}
+
+// RevokeCertificate revokes the (first) cert in certPEM through the directory's revokeCert URL,
+// signing the request with the account key.   The account has to be the one that ordered the cert
+// or hold valid authorizations for all of its names.   If the client doesn't know its account URL
+// yet, as is the case right after NewClient, the account is looked up, but never created, since a
+// new account couldn't revoke anything.
+func (c *Client) RevokeCertificate(ctx context.Context, certPEM []byte, reason RevocationReason) error {
+	req, _, err := newRevokeRequest(certPEM, reason)
+	if err != nil {
+		return err
+	}
+	if c.Directory.RevokeCert == "" {
+		return errors.New("directory does not provide a revokeCert URL")
+	}
+
+	if c.KID == "" {
+		if _, err := c.LookupAccount(ctx); err != nil {
+			if IsAccountDoesNotExist(err) {
+				return fmt.Errorf("no account exists for the account key, use RevokeCertificateWithKey to revoke with the cert's own key: %w", err)
+			}
+			return err
+		}
+	}
+
+	_, err = c.post(ctx, req, c.Directory.RevokeCert, false)
+	return err
+}
+
+// RevokeCertificateWithKey revokes the (first) cert in certPEM like RevokeCertificate, but signs the
+// request with the cert's own private key instead of the account key, embedding the public key in
+// the request.   That works without any account, e.g, for a cert whose key leaked but whose account
+// key is gone.
+func (c *Client) RevokeCertificateWithKey(ctx context.Context, certPEM []byte, certKey crypto.Signer, reason RevocationReason) error {
+	req, cert, err := newRevokeRequest(certPEM, reason)
+	if err != nil {
+		return err
+	}
+	if c.Directory.RevokeCert == "" {
+		return errors.New("directory does not provide a revokeCert URL")
+	}
+	if !publicKeysEqual(cert.PublicKey, certKey.Public()) {
+		return errors.New("key does not belong to the cert being revoked")
+	}
+
+	_, err = c.postSigned(ctx, RequestNoRetry, c.Directory.RevokeCert, func(nonce string) ([]byte, error) {
+		return jwsEncodeJSONWithJWKNonce(certKey, req, c.Directory.RevokeCert, nonce)
+	})
+	return err
+}
+
+// newRevokeRequest builds the revocation payload for the first cert in certPEM, which is also
+// returned parsed.
+func newRevokeRequest(certPEM []byte, reason RevocationReason) (RevokeRequest, *x509.Certificate, error) {
+	var req RevokeRequest
+	if !reason.valid() {
+		return req, nil, fmt.Errorf("invalid revocation reason %d", reason)
+	}
+
+	cert, err := parseCertPEM(certPEM)
+	if err != nil {
+		return req, nil, err
+	}
+
+	req.Certificate = base64.RawURLEncoding.EncodeToString(cert.Raw)
+	req.Reason = reason
+	return req, cert, nil
+}
+
+// publicKeysEqual compares two public keys by their DER encoding, which works for every key type
+// x509 knows about.
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	da, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	db, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(da, db)
+}
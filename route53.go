@@ -2,7 +2,9 @@ package acmev2
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 
@@ -13,6 +15,9 @@ import (
 // Route53 implements DNSModifier to set and remove TXT records from AWS Hosted Zones
 type Route53 struct {
 	r53 *route53.Route53
+	// mu serializes the read-modify-write of TXT record sets so values added for
+	// the same name (e.g, a wildcard and its apex) don't clobber each other.
+	mu sync.Mutex
 }
 
 // NewRoute53 returns a pointer to a Route53 value with an AWS session based on the passed in AWS region.
@@ -30,14 +35,23 @@ func NewRoute53(region string) (*Route53, error) {
 }
 
 // AddTextRecord adds the ACME challenge text record to the DNS entry for a domain.
-// The text record is added to an entry for _acme-challenge.<domain>.
+// The text record is added to an entry for _acme-challenge.<domain>.   Any values already
+// present for that name are kept, so several challenges can be pending for the same name.
 func (c *Route53) AddTextRecord(domain, token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	hostedZoneID, err := findHostedZoneID(c.r53, domain)
 	if err != nil {
 		return err
 	}
 
-	input, err := createChangeRecordSetInput(hostedZoneID, domain, token, "UPSERT")
+	existing, err := c.textValues(hostedZoneID, domain)
+	if err != nil {
+		return err
+	}
+
+	input, err := createChangeRecordSetInput(hostedZoneID, domain, addTXTValue(existing, token), "UPSERT")
 	if err != nil {
 		return err
 	}
@@ -51,14 +65,35 @@ func (c *Route53) AddTextRecord(domain, token string) error {
 	return nil
 }
 
-// RemoveTextRecord removes the ACME challenge text record for cleanup.
+// RemoveTextRecord removes the ACME challenge text record for cleanup.   Only the given value is
+// removed, any other values for the same name are left alone.
 func (c *Route53) RemoveTextRecord(domain, token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	hostedZoneID, err := findHostedZoneID(c.r53, domain)
 	if err != nil {
 		return err
 	}
 
-	input, err := createChangeRecordSetInput(hostedZoneID, domain, token, "DELETE")
+	existing, err := c.textValues(hostedZoneID, domain)
+	if err != nil {
+		return err
+	}
+
+	remaining := removeTXTValue(existing, token)
+	if len(remaining) == len(existing) {
+		// Nothing of ours to remove.
+		return nil
+	}
+
+	var input *route53.ChangeResourceRecordSetsInput
+	if len(remaining) == 0 {
+		// A DELETE has to match the current record set exactly.
+		input, err = createChangeRecordSetInput(hostedZoneID, domain, existing, "DELETE")
+	} else {
+		input, err = createChangeRecordSetInput(hostedZoneID, domain, remaining, "UPSERT")
+	}
 	if err != nil {
 		return err
 	}
@@ -71,12 +106,72 @@ func (c *Route53) RemoveTextRecord(domain, token string) error {
 	return nil
 }
 
-func createChangeRecordSetInput(hostedZoneID, domain, token, action string) (*route53.ChangeResourceRecordSetsInput, error) {
-	var input route53.ChangeResourceRecordSetsInput
+// textValues returns the (unquoted) values of the current _acme-challenge TXT record for domain.
+func (c *Route53) textValues(hostedZoneID, domain string) ([]string, error) {
+	name := challengeRecordName(domain)
+	out, err := c.r53.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(hostedZoneID),
+		StartRecordName: aws.String(name),
+		StartRecordType: aws.String("TXT"),
+		MaxItems:        aws.String("1"),
+	})
+	if err != nil {
+		return nil, err
+	}
 
+	var values []string
+	for _, rrs := range out.ResourceRecordSets {
+		if !strings.EqualFold(strings.TrimSuffix(aws.StringValue(rrs.Name), "."), name) || aws.StringValue(rrs.Type) != "TXT" {
+			continue
+		}
+		for _, rr := range rrs.ResourceRecords {
+			v, err := strconv.Unquote(aws.StringValue(rr.Value))
+			if err != nil {
+				v = aws.StringValue(rr.Value)
+			}
+			values = append(values, v)
+		}
+	}
+
+	return values, nil
+}
+
+// addTXTValue returns values with token added, unless it's already there.
+func addTXTValue(values []string, token string) []string {
+	for _, v := range values {
+		if v == token {
+			return values
+		}
+	}
+	return append(append(make([]string, 0, len(values)+1), values...), token)
+}
+
+// removeTXTValue returns values without token.
+func removeTXTValue(values []string, token string) []string {
+	remaining := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != token {
+			remaining = append(remaining, v)
+		}
+	}
+	return remaining
+}
+
+// challengeRecordName returns the name of the TXT record holding the ACME challenge for domain.
+func challengeRecordName(domain string) string {
 	// Strip leading wildcard for text record if present.
-	if domain[:2] == "*." {
-		domain = domain[2:]
+	domain = strings.TrimPrefix(domain, "*.")
+	return fmt.Sprintf("_acme-challenge.%s", strings.TrimSuffix(domain, "."))
+}
+
+func createChangeRecordSetInput(hostedZoneID, domain string, tokens []string, action string) (*route53.ChangeResourceRecordSetsInput, error) {
+	var input route53.ChangeResourceRecordSetsInput
+
+	records := make([]*route53.ResourceRecord, 0, len(tokens))
+	for _, token := range tokens {
+		records = append(records, &route53.ResourceRecord{
+			Value: aws.String(fmt.Sprintf("%q", token)),
+		})
 	}
 
 	input = route53.ChangeResourceRecordSetsInput{
@@ -85,14 +180,10 @@ func createChangeRecordSetInput(hostedZoneID, domain, token, action string) (*ro
 				{
 					Action: aws.String(action),
 					ResourceRecordSet: &route53.ResourceRecordSet{
-						Name: aws.String(fmt.Sprintf("_acme-challenge.%s", domain)),
-						ResourceRecords: []*route53.ResourceRecord{
-							{
-								Value: aws.String(fmt.Sprintf("%q", token)),
-							},
-						},
-						TTL:  aws.Int64(20),
-						Type: aws.String("TXT"),
+						Name:            aws.String(challengeRecordName(domain)),
+						ResourceRecords: records,
+						TTL:             aws.Int64(20),
+						Type:            aws.String("TXT"),
 					},
 				},
 			},
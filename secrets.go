@@ -8,6 +8,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 )
 
@@ -36,13 +37,16 @@ const (
 	cert
 )
 
-// Store takes a key, cert, and domain and stores it in AWS Secrets Manager
+// Store takes a key, cert, and domain and stores it in AWS Secrets Manager.   An empty key leaves the
+// key stored before alone, since it belongs to a cert key that can't be exported.
 func (c *ASMCertStore) Store(keyPEM, certPEM, domain string) error {
-	err := c.addSecret(keyPEM, domain, key)
-	if err != nil {
-		return err
+	if keyPEM != "" {
+		err := c.addSecret(keyPEM, domain, key)
+		if err != nil {
+			return err
+		}
 	}
-	err = c.addSecret(certPEM, domain, cert)
+	err := c.addSecret(certPEM, domain, cert)
 	return err
 }
 
@@ -73,30 +77,87 @@ func (c *ASMCertStore) addSecret(pem, domain string, secretType int) error {
 		return err
 	}
 
+	return putSecret(c.asm, secretName, string(secretBytes))
+}
+
+// putSecret stores value in the secret called name.
+func putSecret(asm *secretsmanager.SecretsManager, name, value string) error {
 	// Try to update first.   This is likely going to be the
 	// most common use case, as a secret will be updated every
 	// couple of months or so but only created once.   If it
 	// errors, check to see if it's secretsmanager.ErrCodeResourceNotFoundException,
 	// and if so, go ahead and create the new secret.
-	_, err = c.asm.UpdateSecret(&secretsmanager.UpdateSecretInput{
-		SecretId:     aws.String(secretName),
-		SecretString: aws.String(string(secretBytes)),
+	_, err := asm.UpdateSecret(&secretsmanager.UpdateSecretInput{
+		SecretId:     aws.String(name),
+		SecretString: aws.String(value),
 	})
 
 	if err != nil {
-		_, err2 := c.asm.CreateSecret(&secretsmanager.CreateSecretInput{
-			Name:         aws.String(secretName),
-			SecretString: aws.String(string(secretBytes)),
+		_, err2 := asm.CreateSecret(&secretsmanager.CreateSecretInput{
+			Name:         aws.String(name),
+			SecretString: aws.String(value),
 		})
 		if err2 != nil {
-			fmt.Printf("Failed creating secret: %v\n", err)
-			return err
+			fmt.Printf("Failed creating secret: %v\n", err2)
+			return err2
 		}
 	}
 
 	return nil
 }
 
+// ASMAccountStore implements the AccountStore interface to keep ACME accounts in AWS Secrets Manager.
+type ASMAccountStore struct {
+	asm *secretsmanager.SecretsManager
+}
+
+// NewASMAccountStore returns a pointer to an ASMAccountStore value with an AWS session based on the passed in AWS region.
+func NewASMAccountStore(region string) (*ASMAccountStore, error) {
+	s, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	return &ASMAccountStore{asm: secretsmanager.New(s)}, nil
+}
+
+// LoadAccount fetches the account stored for dirURL, if there is one.
+func (c *ASMAccountStore) LoadAccount(dirURL string) (*StoredAccount, error) {
+	out, err := c.asm.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(accountSecretName(dirURL)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var secret Secret
+	if err := json.Unmarshal([]byte(aws.StringValue(out.SecretString)), &secret); err != nil {
+		return nil, err
+	}
+	return unmarshalStoredAccount([]byte(secret.Value))
+}
+
+// SaveAccount stores the account for dirURL.
+func (c *ASMAccountStore) SaveAccount(dirURL string, acct StoredAccount) error {
+	acctBytes, err := marshalStoredAccount(acct)
+	if err != nil {
+		return err
+	}
+
+	secretBytes, err := json.Marshal(Secret{Type: "opaque", Value: string(acctBytes)})
+	if err != nil {
+		return err
+	}
+
+	return putSecret(c.asm, accountSecretName(dirURL), string(secretBytes))
+}
+
+func accountSecretName(dirURL string) string {
+	return fmt.Sprintf("acme_account_%s", accountName(dirURL))
+}
+
 func genSecretInput(name, value string) secretsmanager.CreateSecretInput {
 	return secretsmanager.CreateSecretInput{
 		Name:         aws.String(name),
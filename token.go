@@ -10,13 +10,19 @@ package acmev2
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
+	"strings"
 )
 
 // Message is a JWS message for ACME
@@ -57,7 +63,7 @@ func (c *Client) JWSEncodeJSON(claimset interface{}, url string, postAsGet bool)
 	}
 
 	alg, sha := jwsHasher(c.Key.Public())
-	if alg == "" || !sha.Available() {
+	if alg == "" || (sha != 0 && !sha.Available()) {
 		return b, errors.New("Unsupported key")
 	}
 	var phead string
@@ -74,17 +80,103 @@ func (c *Client) JWSEncodeJSON(claimset interface{}, url string, postAsGet bool)
 		return b, err
 	}
 
-	fmt.Printf("Encoding %s into base64\n", cs)
 	var payload string
 	if postAsGet {
 		payload = ""
 	} else {
 		payload = base64.RawURLEncoding.EncodeToString(cs)
 	}
-	hash := sha.New()
-	hash.Write([]byte(phead + "." + payload))
+	return jwsFinish(c.Key, sha, phead, payload)
+}
+
+// jwsEncodeJSONWithJWK signs a claimset with the provided key, embedding the public
+// key as a JWK and leaving out the nonce.   This is what the inner JWS of an account
+// key rollover looks like (RFC 8555, section 7.3.5).
+func jwsEncodeJSONWithJWK(key crypto.Signer, claimset interface{}, url string) ([]byte, error) {
+	return jwsEncodeJSONWithJWKNonce(key, claimset, url, "")
+}
+
+// jwsEncodeJSONWithJWKNonce works like jwsEncodeJSONWithJWK, but includes nonce in the protected
+// header unless it's empty.   That's what a request signed with some key other than the account
+// key looks like, e.g, revoking a cert with the cert's own key (RFC 8555, section 7.6).
+func jwsEncodeJSONWithJWKNonce(key crypto.Signer, claimset interface{}, url, nonce string) ([]byte, error) {
+	jwk, err := jwkEncode(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	alg, sha := jwsHasher(key.Public())
+	if alg == "" || (sha != 0 && !sha.Available()) {
+		return nil, errors.New("Unsupported key")
+	}
+	var phead string
+	if nonce == "" {
+		phead = fmt.Sprintf(`{"alg":%q,"jwk":%s,"url":%q}`, alg, jwk, url)
+	} else {
+		phead = fmt.Sprintf(`{"alg":%q,"jwk":%s,"nonce":%q,"url":%q}`, alg, jwk, nonce, url)
+	}
+	phead = base64.RawURLEncoding.EncodeToString([]byte(phead))
+
+	cs, err := json.Marshal(claimset)
+	if err != nil {
+		return nil, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(cs)
+
+	return jwsFinish(key, sha, phead, payload)
+}
+
+// jwsEncodeEAB creates the externalAccountBinding JWS for a new account request, which
+// is the account's public key as a JWK, MAC'd with the HMAC key handed out by the CA
+// (RFC 8555, section 7.3.4).
+func jwsEncodeEAB(pub crypto.PublicKey, keyID string, hmacKey []byte, url string) ([]byte, error) {
+	jwk, err := jwkEncode(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	phead := fmt.Sprintf(`{"alg":"HS256","kid":%q,"url":%q}`, keyID, url)
+	phead = base64.RawURLEncoding.EncodeToString([]byte(phead))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(jwk))
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(phead + "." + payload))
+
+	enc := struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Sig       string `json:"signature"`
+	}{
+		Protected: phead,
+		Payload:   payload,
+		Sig:       base64.RawURLEncoding.EncodeToString(mac.Sum(nil)),
+	}
+	return json.Marshal(&enc)
+}
 
-	sig, err := jwsSign(c.Key, sha, hash.Sum(nil))
+// decodeEABKey decodes an EAB HMAC key.   CAs hand these out base64url encoded, though
+// not all of them agree on whether to include padding.
+func decodeEABKey(key string) ([]byte, error) {
+	key = strings.TrimRight(strings.TrimSpace(key), "=")
+	if key == "" {
+		return nil, errors.New("empty key")
+	}
+	return base64.RawURLEncoding.DecodeString(key)
+}
+
+// jwsFinish signs the already encoded protected header and payload and serializes
+// the result in the flattened JSON format.   A zero hash means the key signs the
+// message itself rather than a digest of it, as Ed25519 does.
+func jwsFinish(key crypto.Signer, sha crypto.Hash, phead, payload string) ([]byte, error) {
+	var sig []byte
+	var err error
+	if sha == 0 {
+		sig, err = key.Sign(rand.Reader, []byte(phead+"."+payload), crypto.Hash(0))
+	} else {
+		hash := sha.New()
+		hash.Write([]byte(phead + "." + payload))
+		sig, err = jwsSign(key, sha, hash.Sum(nil))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -132,6 +224,11 @@ func jwkEncode(pub crypto.PublicKey) (string, error) {
 			base64.RawURLEncoding.EncodeToString(x),
 			base64.RawURLEncoding.EncodeToString(y),
 		), nil
+	case ed25519.PublicKey:
+		// https://tools.ietf.org/html/rfc8037#section-2
+		return fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`,
+			base64.RawURLEncoding.EncodeToString(pub),
+		), nil
 	}
 	return "", errors.New("Unsupported key type")
 }
@@ -145,20 +242,39 @@ func jwsSign(key crypto.Signer, hash crypto.Hash, digest []byte) ([]byte, error)
 		if err != nil {
 			return nil, err
 		}
-		rb, sb := r.Bytes(), s.Bytes()
-		size := key.Params().BitSize / 8
-		if size%8 > 0 {
-			size++
+		return ecdsaJWSSignature(key.Params(), r, s), nil
+	}
+	if pub, ok := key.Public().(*ecdsa.PublicKey); ok {
+		// Other ECDSA signers (HSMs, KMS) only give us the ASN1-encoded
+		// signature, so unpack R and S from that.
+		der, err := key.Sign(rand.Reader, digest, hash)
+		if err != nil {
+			return nil, err
+		}
+		var p ecPoint
+		if _, err := asn1.Unmarshal(der, &p); err != nil {
+			return nil, err
 		}
-		sig := make([]byte, size*2)
-		copy(sig[size-len(rb):], rb)
-		copy(sig[size*2-len(sb):], sb)
-
-		return sig, nil
+		return ecdsaJWSSignature(pub.Params(), p.R, p.S), nil
 	}
 	return key.Sign(rand.Reader, digest, hash)
 }
 
+// ecdsaJWSSignature formats R and S as the fixed size concatenation JWS expects
+// (https://tools.ietf.org/html/rfc7518#section-3.4).
+func ecdsaJWSSignature(params *elliptic.CurveParams, r, s *big.Int) []byte {
+	rb, sb := r.Bytes(), s.Bytes()
+	size := params.BitSize / 8
+	if params.BitSize%8 > 0 {
+		size++
+	}
+	sig := make([]byte, size*2)
+	copy(sig[size-len(rb):], rb)
+	copy(sig[size*2-len(sb):], sb)
+
+	return sig
+}
+
 func jwsHasher(pub crypto.PublicKey) (string, crypto.Hash) {
 	switch pub := pub.(type) {
 	case *rsa.PublicKey:
@@ -172,6 +288,25 @@ func jwsHasher(pub crypto.PublicKey) (string, crypto.Hash) {
 		case "P-521":
 			return "ES512", crypto.SHA512
 		}
+	case ed25519.PublicKey:
+		return "EdDSA", 0
 	}
 	return "", 0
 }
+
+// validateAccountKey checks that key is something we know how to sign ACME requests with.
+func validateAccountKey(key crypto.Signer) error {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		if bits := pub.N.BitLen(); bits < 2048 || bits > 4096 {
+			return fmt.Errorf("RSA account key must be 2048 to 4096 bits, got %d", bits)
+		}
+		return nil
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		if alg, _ := jwsHasher(pub); alg == "" {
+			return errors.New("ECDSA account key must use P-256, P-384 or P-521")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported account key type %T", key.Public())
+}